@@ -0,0 +1,177 @@
+package simplegraphdb
+
+import (
+	"sort"
+
+	"github.com/thundergolfer/simplegraphdb/simplesparql"
+)
+
+// isAggregateQuery gives whether a query groups its solutions, either
+// explicitly with GROUP BY or by using aggregates
+func isAggregateQuery(queryModel *(simplesparql.Select)) bool {
+	if len(queryModel.GroupBy) > 0 || queryModel.Having != nil {
+		return true
+	}
+	for _, projection := range queryModel.Expression.Projections {
+		if projection.Aggregate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// groupedSolutions collects every solution of its input into groups which
+// bind the GROUP BY variables to the same terms, and yields a solution per
+// group binding those variables and the selected aggregates. Groups are
+// yielded in the order they were first found, and without GROUP BY every
+// solution falls in one group. Groups failing the HAVING condition are dropped
+type groupedSolutions struct {
+	input       solutionIterator
+	groupBy     []string
+	projections []*simplesparql.Projection
+	having      *simplesparql.Expression
+	grouped     []solution
+	populated   bool
+	current     solution
+}
+
+func (it *groupedSolutions) next() bool {
+	if !it.populated {
+		it.populated = true
+		it.populate()
+	}
+
+	if len(it.grouped) == 0 {
+		return false
+	}
+	it.current, it.grouped = it.grouped[0], it.grouped[1:]
+	return true
+}
+
+func (it *groupedSolutions) populate() {
+	var keys []string
+	groups := map[string][]solution{}
+	for it.input.next() {
+		sol := it.input.solution()
+		key := solutionKey(sol, it.groupBy)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], sol)
+	}
+	if it.input.err() != nil {
+		return
+	}
+
+	if len(it.groupBy) == 0 && len(keys) == 0 {
+		// aggregates over no solutions still give a result, eg. a count of 0
+		keys = append(keys, "")
+		groups[""] = []solution{}
+	}
+
+	for _, key := range keys {
+		members := groups[key]
+
+		grouped := solution{}
+		if len(members) > 0 {
+			for _, v := range it.groupBy {
+				if val, ok := members[0][v]; ok {
+					grouped[v] = val
+				}
+			}
+		}
+		for _, projection := range it.projections {
+			if projection.Aggregate == nil {
+				continue
+			}
+			if val, ok := computeAggregate(projection.Aggregate.Aggregate, members); ok {
+				grouped[projection.Aggregate.As] = val.String()
+			}
+		}
+
+		if it.having != nil {
+			t, ok := evaluateExpression(it.having, expressionScope{sol: grouped, group: members})
+			if keep, boolOk := effectiveBooleanValue(t); !ok || !boolOk || !keep {
+				continue
+			}
+		}
+		it.grouped = append(it.grouped, grouped)
+	}
+}
+
+func (it *groupedSolutions) solution() solution { return it.current }
+
+func (it *groupedSolutions) err() error { return it.input.err() }
+
+func (it *groupedSolutions) close() {
+	it.grouped = nil
+	it.input.close()
+}
+
+// computeAggregate computes an aggregate over a group of solutions. COUNT,
+// SUM and AVG of an empty group are 0, but MIN and MAX of an empty group have
+// no value, and neither does the SUM or AVG of a group holding a non-number
+func computeAggregate(agg *simplesparql.Aggregate, group []solution) (Term, bool) {
+	var values []Term
+	seen := map[string]bool{}
+	for _, sol := range group {
+		var key string
+		if agg.All {
+			key = solutionKey(sol, sortedVariables(sol))
+		} else {
+			val, ok := sol[agg.Var]
+			if !ok {
+				continue
+			}
+			key = val
+		}
+
+		if agg.Distinct {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		values = append(values, ParseTerm(key))
+	}
+
+	switch agg.Function {
+	case "COUNT":
+		return newNumber(float64(len(values))), true
+	case "SUM", "AVG":
+		var sum float64
+		for _, val := range values {
+			n, ok := numericValue(val)
+			if !ok {
+				return Term{}, false
+			}
+			sum += n
+		}
+		if agg.Function == "AVG" && len(values) > 0 {
+			sum /= float64(len(values))
+		}
+		return newNumber(sum), true
+	case "MIN", "MAX":
+		if len(values) == 0 {
+			return Term{}, false
+		}
+		best := values[0]
+		for _, val := range values[1:] {
+			c := compareTerms(val, best)
+			if (agg.Function == "MIN" && c < 0) || (agg.Function == "MAX" && c > 0) {
+				best = val
+			}
+		}
+		return best, true
+	}
+	return Term{}, false
+}
+
+func sortedVariables(sol solution) []string {
+	vars := make([]string, 0, len(sol))
+	for v := range sol {
+		vars = append(vars, v)
+	}
+	sort.Strings(vars)
+	return vars
+}
@@ -0,0 +1,646 @@
+package simplegraphdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Every index and dictionary of a DiskHexastore lives in the one sorted key
+// space, told apart by the first byte of the key. Index keys follow it with
+// the three IDs of a triple as big-endian uint64s, in the index's order, so
+// that all triples sharing leading IDs sit in one contiguous key range.
+const (
+	diskSPO byte = iota
+	diskSOP
+	diskPSO
+	diskPOS
+	diskOSP
+	diskOPS
+
+	diskEntityKeys   byte = 'e' // entity string -> ID
+	diskEntityValues byte = 'E' // entity ID -> string
+	diskPropKeys     byte = 'p' // property string -> ID
+	diskPropValues   byte = 'P' // property ID -> string
+	diskCounters     byte = '#' // next free entity and property IDs
+
+	defaultFlushThreshold = 1 << 16
+	maxSegments           = 8
+)
+
+// diskIndexOrder gives, for each index, which of subject (0), property (1)
+// and object (2) sits at each position of its keys
+var diskIndexOrder = [6][3]int{
+	diskSPO: {0, 1, 2},
+	diskSOP: {0, 2, 1},
+	diskPSO: {1, 0, 2},
+	diskPOS: {1, 2, 0},
+	diskOSP: {2, 0, 1},
+	diskOPS: {2, 1, 0},
+}
+
+// DiskHexastore is a Hexastore whose six indexes and dictionaries are kept in
+// sorted segment files on disk, so that graphs larger than memory can be queried.
+// Recent updates are held in memory until Flush or Close writes them out; they
+// aren't logged, so a crash loses any updates made since the last flush.
+//
+// Like DurableHexastore, the first I/O error hit is kept and returned by Err,
+// since neither queries nor Add can return one
+type DiskHexastore struct {
+	dir            string
+	mem            *memtable
+	segments       []*segment // oldest first
+	nextSeq        int
+	nextEntity     int
+	nextProp       int
+	flushThreshold int
+	closed         bool
+	mu             sync.RWMutex
+
+	errMu sync.Mutex
+	err   error
+}
+
+// OpenDiskHexastore opens the on-disk store kept in dir, creating it if needed
+func OpenDiskHexastore(dir string) (*DiskHexastore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "segment-*.sst"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths) // sequence numbers are zero padded, so this is oldest first
+
+	store := &DiskHexastore{dir: dir, mem: &memtable{}, flushThreshold: defaultFlushThreshold}
+	for _, path := range paths {
+		var seq int
+		if _, err = fmt.Sscanf(filepath.Base(path), "segment-%d.sst", &seq); err != nil {
+			continue
+		}
+
+		seg, err := openSegment(path, seq)
+		if err != nil {
+			store.closeSegments()
+			return nil, err
+		}
+		store.segments = append(store.segments, seg)
+		store.nextSeq = seq + 1
+	}
+
+	if val, ok := store.get(string(diskCounters) + "entities"); ok {
+		store.nextEntity = decodeDiskID(val)
+	}
+	if val, ok := store.get(string(diskCounters) + "props"); ok {
+		store.nextProp = decodeDiskID(val)
+	}
+	if err = store.Err(); err != nil {
+		store.closeSegments()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func encodeDiskID(id int) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(id))
+	return string(buf[:])
+}
+
+func decodeDiskID(s string) int {
+	if len(s) < 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64([]byte(s[:8])))
+}
+
+// indexKey builds the key, or key prefix if fewer than three IDs are given,
+// of an index. ids must already be in the index's order
+func indexKey(index byte, ids ...int) string {
+	key := []byte{index}
+	for _, id := range ids {
+		key = append(key, encodeDiskID(id)...)
+	}
+	return string(key)
+}
+
+func tripleIndexKey(index byte, t *Triple) string {
+	parts := [3]int{t.Subject, t.Prop, t.Object}
+	order := diskIndexOrder[index]
+	return indexKey(index, parts[order[0]], parts[order[1]], parts[order[2]])
+}
+
+func decodeIndexEntry(index byte, e lsmEntry) Triple {
+	var parts [3]int
+	for i, pos := range diskIndexOrder[index] {
+		parts[pos] = decodeDiskID(e.key[1+8*i:])
+	}
+	return Triple{Subject: parts[0], Prop: parts[1], Object: parts[2], Value: e.value}
+}
+
+func (store *DiskHexastore) setErr(err error) {
+	store.errMu.Lock()
+	defer store.errMu.Unlock()
+
+	if store.err == nil {
+		store.err = err
+	}
+}
+
+// Err returns the first I/O error hit by the store, or ErrStoreClosed
+// once the store is closed
+func (store *DiskHexastore) Err() error {
+	store.errMu.Lock()
+	defer store.errMu.Unlock()
+
+	return store.err
+}
+
+// scan merges the memtable and every segment, newest first. The caller must hold the lock
+func (store *DiskHexastore) scan(prefix string) lsmIterator {
+	return store.scanFrom(prefix, prefix)
+}
+
+// scanFrom is scan starting from the first key >= start rather than the start of the prefix
+func (store *DiskHexastore) scanFrom(start, prefix string) lsmIterator {
+	its := []lsmIterator{store.mem.scan(start)}
+	for i := len(store.segments) - 1; i >= 0; i-- {
+		its = append(its, store.segments[i].scan(start))
+	}
+	return &liveIterator{it: newMergeIterator(its), prefix: prefix}
+}
+
+// get finds the live value for a key. The caller must hold the lock
+func (store *DiskHexastore) get(key string) (string, bool) {
+	if i := store.mem.seek(key); i < len(store.mem.entries) && store.mem.entries[i].key == key {
+		e := store.mem.entries[i]
+		return e.value, !e.tombstone
+	}
+
+	for i := len(store.segments) - 1; i >= 0; i-- {
+		it := store.segments[i].scan(key)
+		if it.next() && it.entry().key == key {
+			return it.entry().value, !it.entry().tombstone
+		}
+		if err := it.err(); err != nil {
+			store.setErr(err)
+			return "", false
+		}
+	}
+
+	return "", false
+}
+
+func (store *DiskHexastore) queryIndex(index byte, ids ...int) *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	res := []Triple{}
+	if store.closed {
+		return &res
+	}
+
+	it := store.scan(indexKey(index, ids...))
+	for it.next() {
+		res = append(res, decodeIndexEntry(index, it.entry()))
+	}
+	if err := it.err(); err != nil {
+		store.setErr(err)
+	}
+
+	return &res
+}
+
+// diskIteratorBatch is how many triples a diskIterator reads each time it takes the lock
+const diskIteratorBatch = 256
+
+// diskIterator reads an index range in batches, taking the store's read lock for
+// each batch and resuming after the last key read, so that flushes and
+// compactions can carry on between batches
+type diskIterator struct {
+	store   *DiskHexastore
+	index   byte
+	prefix  string
+	start   string
+	batch   []Triple
+	done    bool
+	failure error
+	current Triple
+}
+
+func (store *DiskHexastore) iterIndex(index byte, ids ...int) TripleIterator {
+	prefix := indexKey(index, ids...)
+	return &diskIterator{store: store, index: index, prefix: prefix, start: prefix}
+}
+
+func (it *diskIterator) Next() bool {
+	if len(it.batch) == 0 && !it.done {
+		it.readBatch()
+	}
+	if len(it.batch) == 0 {
+		return false
+	}
+
+	it.current, it.batch = it.batch[0], it.batch[1:]
+	return true
+}
+
+func (it *diskIterator) readBatch() {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+
+	if it.store.closed {
+		it.done, it.failure = true, ErrStoreClosed
+		return
+	}
+
+	scan := it.store.scanFrom(it.start, it.prefix)
+	for len(it.batch) < diskIteratorBatch && scan.next() {
+		e := scan.entry()
+		it.batch = append(it.batch, decodeIndexEntry(it.index, e))
+		it.start = e.key + "\x00"
+	}
+	if err := scan.err(); err != nil {
+		it.store.setErr(err)
+		it.done, it.failure = true, err
+	}
+	if len(it.batch) < diskIteratorBatch {
+		it.done = true
+	}
+}
+
+func (it *diskIterator) Triple() Triple { return it.current }
+
+func (it *diskIterator) Err() error { return it.failure }
+
+func (it *diskIterator) Close() error {
+	it.done, it.batch = true, nil
+	return nil
+}
+
+// IterXXX iterates over every triple in the store
+func (store *DiskHexastore) IterXXX() TripleIterator {
+	return store.iterIndex(diskSPO)
+}
+
+// IterSXX iterates over the triples with a given subject
+func (store *DiskHexastore) IterSXX(subjID int) TripleIterator {
+	return store.iterIndex(diskSPO, subjID)
+}
+
+// IterXPX iterates over the triples with a given property
+func (store *DiskHexastore) IterXPX(propID int) TripleIterator {
+	return store.iterIndex(diskPSO, propID)
+}
+
+// IterXXO iterates over the triples with a given object
+func (store *DiskHexastore) IterXXO(objID int) TripleIterator {
+	return store.iterIndex(diskOPS, objID)
+}
+
+// IterSPX iterates over the triples with a given subject and property
+func (store *DiskHexastore) IterSPX(subjID, propID int) TripleIterator {
+	return store.iterIndex(diskSPO, subjID, propID)
+}
+
+// IterSXO iterates over the triples with a given subject and object
+func (store *DiskHexastore) IterSXO(subjID, objID int) TripleIterator {
+	return store.iterIndex(diskSOP, subjID, objID)
+}
+
+// IterXPO iterates over the triples with a given property and object
+func (store *DiskHexastore) IterXPO(propID, objID int) TripleIterator {
+	return store.iterIndex(diskPOS, propID, objID)
+}
+
+// IterSPO iterates over the triple with a given subject, property and object, if it's in the store
+func (store *DiskHexastore) IterSPO(subjID, propID, objID int) TripleIterator {
+	return store.iterIndex(diskSPO, subjID, propID, objID)
+}
+
+// QueryXXX returns every triple in the store
+func (store *DiskHexastore) QueryXXX() *[]Triple {
+	return store.queryIndex(diskSPO)
+}
+
+// QuerySXX queries the store specifying only a Subject entity ID
+func (store *DiskHexastore) QuerySXX(subjID int) *[]Triple {
+	return store.queryIndex(diskSPO, subjID)
+}
+
+// QueryXPX queries the store specifying only a Property ID
+func (store *DiskHexastore) QueryXPX(propID int) *[]Triple {
+	return store.queryIndex(diskPSO, propID)
+}
+
+// QueryXXO queries the store specifying only an Object entity ID
+func (store *DiskHexastore) QueryXXO(objID int) *[]Triple {
+	return store.queryIndex(diskOPS, objID)
+}
+
+// QuerySPX queries the store specifying a Subject entity ID and a Property ID
+func (store *DiskHexastore) QuerySPX(subjID, propID int) *[]Triple {
+	return store.queryIndex(diskSPO, subjID, propID)
+}
+
+// QuerySXO queries the store specifying a Subject entity ID and an Object entity ID
+func (store *DiskHexastore) QuerySXO(subjID, objID int) *[]Triple {
+	return store.queryIndex(diskSOP, subjID, objID)
+}
+
+// QueryXPO queries the store specifying a Property ID and an Object entity ID
+func (store *DiskHexastore) QueryXPO(propID, objID int) *[]Triple {
+	return store.queryIndex(diskPOS, propID, objID)
+}
+
+// QuerySPO queries the store for a specific triple
+func (store *DiskHexastore) QuerySPO(subjID, propID, objID int) *[]Triple {
+	return store.queryIndex(diskSPO, subjID, propID, objID)
+}
+
+func (store *DiskHexastore) lookupKey(kind byte, val string) (int, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if store.closed {
+		return 0, false
+	}
+	id, ok := store.get(string(kind) + canonicalTerm(val))
+	if !ok {
+		return 0, false
+	}
+	return decodeDiskID(id), true
+}
+
+func (store *DiskHexastore) resolve(kind byte, id int) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if store.closed {
+		return ""
+	}
+	val, _ := store.get(string(kind) + encodeDiskID(id))
+	return val
+}
+
+// GetPropKey finds the integer id for a particular string value which is a property
+func (store *DiskHexastore) GetPropKey(val string) (int, bool) {
+	return store.lookupKey(diskPropKeys, val)
+}
+
+// GetEntityKey finds the integer id for a particular string value which is an entity (object or subject)
+func (store *DiskHexastore) GetEntityKey(val string) (int, bool) {
+	return store.lookupKey(diskEntityKeys, val)
+}
+
+// ResolveEntity finds the string value for a given entity ID
+func (store *DiskHexastore) ResolveEntity(id int) string {
+	return store.resolve(diskEntityValues, id)
+}
+
+// ResolveProp finds the string value for a given property ID
+func (store *DiskHexastore) ResolveProp(id int) string {
+	return store.resolve(diskPropValues, id)
+}
+
+// putID finds the ID of a string value, assigning it the next free ID if it's
+// new. The caller must hold the write lock
+func (store *DiskHexastore) putID(keys, values byte, counter string, next *int, val string) int {
+	if id, ok := store.get(string(keys) + val); ok {
+		return decodeDiskID(id)
+	}
+
+	id := *next
+	*next++
+	store.mem.put(lsmEntry{key: string(keys) + val, value: encodeDiskID(id)})
+	store.mem.put(lsmEntry{key: string(values) + encodeDiskID(id), value: val})
+	store.mem.put(lsmEntry{key: string(diskCounters) + counter, value: encodeDiskID(*next)})
+	return id
+}
+
+// apply performs a single update, returning false if it was the removal of
+// a triple which wasn't in the store. The caller must hold the write lock
+func (store *DiskHexastore) apply(op txOp) bool {
+	op.subject, op.property, op.object = canonicalTerm(op.subject), canonicalTerm(op.property), canonicalTerm(op.object)
+
+	var t Triple
+	if op.remove {
+		subj, subjOk := store.get(string(diskEntityKeys) + op.subject)
+		prop, propOk := store.get(string(diskPropKeys) + op.property)
+		obj, objOk := store.get(string(diskEntityKeys) + op.object)
+		if !subjOk || !propOk || !objOk {
+			return false
+		}
+		t = Triple{Subject: decodeDiskID(subj), Prop: decodeDiskID(prop), Object: decodeDiskID(obj)}
+		if _, ok := store.get(tripleIndexKey(diskSPO, &t)); !ok {
+			return false
+		}
+	} else {
+		t = Triple{
+			Subject: store.putID(diskEntityKeys, diskEntityValues, "entities", &store.nextEntity, op.subject),
+			Prop:    store.putID(diskPropKeys, diskPropValues, "props", &store.nextProp, op.property),
+			Object:  store.putID(diskEntityKeys, diskEntityValues, "entities", &store.nextEntity, op.object),
+			Value:   op.value,
+		}
+	}
+
+	for index := range diskIndexOrder {
+		store.mem.put(lsmEntry{key: tripleIndexKey(byte(index), &t), value: t.Value, tombstone: op.remove})
+	}
+
+	return true
+}
+
+// applyBatch performs a batch of updates while holding the write lock, then
+// flushes the memtable if it has grown past its threshold
+func (store *DiskHexastore) applyBatch(ops []txOp) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return ErrStoreClosed
+	}
+	for _, op := range ops {
+		store.apply(op)
+	}
+
+	if len(store.mem.entries) >= store.flushThreshold {
+		return store.flush()
+	}
+	return nil
+}
+
+// Add introduces a new triple of plain literals into the store
+func (store *DiskHexastore) Add(subject, property, object, value string) {
+	store.applyBatch([]txOp{{subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object), value: value}})
+}
+
+// Remove deletes a triple of plain literals from the store, returning false
+// if the triple wasn't in the store
+func (store *DiskHexastore) Remove(subject, property, object string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return false
+	}
+	return store.apply(txOp{remove: true, subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object)})
+}
+
+// RemoveMatching deletes every triple matching a pattern in which simplesparql
+// variables (eg. "?x") act as wildcards and other strings are plain literals,
+// returning the number of triples removed
+func (store *DiskHexastore) RemoveMatching(subject, property, object string) int {
+	subject, property, object = plainLiteralPattern(subject, property, object)
+	matches := retreiveQueryResults(subject, property, object, store)
+
+	ops := make([]txOp, len(*matches))
+	for i, t := range *matches {
+		ops[i] = txOp{
+			remove:   true,
+			subject:  store.ResolveEntity(t.Subject),
+			property: store.ResolveProp(t.Prop),
+			object:   store.ResolveEntity(t.Object),
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return 0
+	}
+	removed := 0
+	for _, op := range ops {
+		if store.apply(op) {
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Begin starts a new transaction against the store
+func (store *DiskHexastore) Begin() Tx {
+	return &hexastoreTx{commit: store.applyBatch}
+}
+
+// Flush writes the updates held in memory out to a new segment file
+func (store *DiskHexastore) Flush() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return ErrStoreClosed
+	}
+	return store.flush()
+}
+
+func (store *DiskHexastore) flush() error {
+	if len(store.mem.entries) == 0 {
+		return nil
+	}
+
+	// with no older segments left for them to shadow, tombstones can be dropped
+	path := segmentPath(store.dir, store.nextSeq)
+	if err := writeSegment(path, store.mem.scan(""), len(store.segments) == 0); err != nil {
+		store.setErr(err)
+		return err
+	}
+
+	seg, err := openSegment(path, store.nextSeq)
+	if err != nil {
+		store.setErr(err)
+		return err
+	}
+	store.segments = append(store.segments, seg)
+	store.nextSeq++
+	store.mem = &memtable{}
+
+	if len(store.segments) > maxSegments {
+		return store.compact()
+	}
+	return nil
+}
+
+// compact merges every segment into one. The merged segment is written before
+// any old segment is removed, and old segments are removed oldest first, so a
+// crash part way through never uncovers a deleted or overwritten entry
+func (store *DiskHexastore) compact() error {
+	its := []lsmIterator{}
+	for i := len(store.segments) - 1; i >= 0; i-- {
+		its = append(its, store.segments[i].scan(""))
+	}
+
+	path := segmentPath(store.dir, store.nextSeq)
+	if err := writeSegment(path, newMergeIterator(its), true); err != nil {
+		store.setErr(err)
+		return err
+	}
+
+	merged, err := openSegment(path, store.nextSeq)
+	if err != nil {
+		store.setErr(err)
+		return err
+	}
+	store.nextSeq++
+
+	old := store.segments
+	store.segments = []*segment{merged}
+	for _, seg := range old {
+		seg.file.Close()
+		if err := os.Remove(seg.path); err != nil {
+			store.setErr(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compact flushes the updates held in memory and merges every segment file
+// into one, dropping deleted and overwritten entries
+func (store *DiskHexastore) Compact() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return ErrStoreClosed
+	}
+	if err := store.flush(); err != nil {
+		return err
+	}
+	if len(store.segments) <= 1 {
+		return nil
+	}
+	return store.compact()
+}
+
+func (store *DiskHexastore) closeSegments() {
+	for _, seg := range store.segments {
+		seg.file.Close()
+	}
+}
+
+// Close flushes the updates held in memory and closes the segment files.
+// A closed store answers every query with no results
+func (store *DiskHexastore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if store.closed {
+		return ErrStoreClosed
+	}
+
+	err := store.flush()
+	store.closeSegments()
+	store.closed = true
+	store.setErr(ErrStoreClosed)
+
+	return err
+}
@@ -0,0 +1,139 @@
+package simplegraphdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func openTestDiskHexastore(t *testing.T, dir string, flushThreshold int) *DiskHexastore {
+	store, err := OpenDiskHexastore(dir)
+	if err != nil {
+		t.Fatal("Expected no error opening disk store, got ", err)
+	}
+	store.flushThreshold = flushThreshold
+	return store
+}
+
+func TestDiskHexastoreQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := openTestDiskHexastore(t, dir, 8)
+	defer disk.Close()
+	memory := createTestHexastore()
+	for _, entry := range dumpHexastore(memory).Triples {
+		disk.Add(entry.Subject, entry.Prop, entry.Object, "jonob")
+	}
+
+	queries := []string{
+		"SELECT ?s, ?p, ?o WHERE { ?s ?p ?o }",
+		"SELECT ?p, ?o WHERE { 'Apple' ?p ?o }",
+		"SELECT ?s, ?o WHERE { ?s 'Likes' ?o }",
+		"SELECT ?s, ?p WHERE { ?s ?p 'Cow' }",
+		"SELECT ?o WHERE { 'Apple' 'Likes' ?o }",
+		"SELECT ?p WHERE { 'Cow' ?p 'Banana' }",
+		"SELECT ?s WHERE { ?s 'Likes' 'Apple' }",
+		"SELECT ?a, ?b WHERE { ?a 'Likes' ?b . ?b 'Likes' ?a }",
+	}
+	for _, query := range queries {
+		expected, _ := runQuery(query, memory)
+		actual, err := runQuery(query, disk)
+		if err != nil {
+			t.Errorf("Error in query '%s': %s", query, err)
+		}
+		if len(expected) != len(actual) || !checkResultsEquality(expected, actual) {
+			t.Errorf("Query '%s' on disk store returned %v, expected %v", query, actual, expected)
+		}
+	}
+
+	if len(*disk.QuerySPO(0, 0, 1)) != len(*memory.QuerySPO(0, 0, 1)) {
+		t.Error("Disk and memory stores disagree on a specific triple query")
+	}
+}
+
+func TestDiskHexastoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := openTestDiskHexastore(t, dir, 16)
+	memory := newHexastore()
+	for i := 0; i < 300; i++ {
+		subject, object := fmt.Sprintf("user-%d", i%40), fmt.Sprintf("user-%d", (i*7)%40)
+		disk.Add(subject, "follows", object, fmt.Sprint(i))
+		memory.Add(subject, "follows", object, fmt.Sprint(i))
+		if i%3 == 0 {
+			disk.Remove(object, "follows", subject)
+			memory.Remove(object, "follows", subject)
+		}
+	}
+	disk.RemoveMatching("user-1", "?p", "?o")
+	memory.RemoveMatching("user-1", "?p", "?o")
+
+	if len(disk.segments) > maxSegments {
+		t.Error("Expected segments to be compacted, got ", len(disk.segments))
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatal("Expected no error closing disk store, got ", err)
+	}
+
+	reopened := openTestDiskHexastore(t, dir, 16)
+	defer reopened.Close()
+
+	if diff := deep.Equal(dumpHexastore(memory), dumpHexastore(reopened)); diff != nil {
+		t.Error(diff)
+	}
+
+	// IDs carry on from where the store left off
+	reopened.Add("newcomer", "follows", "user-2", "")
+	newcomerID, _ := reopened.GetEntityKey("newcomer")
+	if reopened.ResolveEntity(newcomerID) != "newcomer" || newcomerID != 40 {
+		t.Error("Expected new entity to be given the next free ID 40, got ", newcomerID)
+	}
+
+	if err := reopened.Compact(); err != nil {
+		t.Fatal("Expected no error compacting, got ", err)
+	}
+	if len(reopened.segments) != 1 {
+		t.Error("Expected a single segment after compaction, got ", len(reopened.segments))
+	}
+	memory.Add("newcomer", "follows", "user-2", "")
+	if diff := deep.Equal(dumpHexastore(memory), dumpHexastore(reopened)); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDiskHexastoreTx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk := openTestDiskHexastore(t, dir, defaultFlushThreshold)
+	defer disk.Close()
+
+	tx := disk.Begin()
+	tx.Add("alice", "follows", "bob", "")
+	tx.Add("bob", "follows", "alice", "")
+	if len(*disk.QueryXXX()) != 0 {
+		t.Error("Uncommitted transaction updates were visible in the store")
+	}
+	tx.Commit()
+
+	if !disk.Remove("alice", "follows", "bob") || disk.Remove("alice", "follows", "bob") {
+		t.Error("Expected Remove to report true once and then false")
+	}
+	if n := len(*disk.QueryXXX()); n != 1 {
+		t.Error("Expected 1 triple left in store, got ", n)
+	}
+}
@@ -0,0 +1,477 @@
+package simplegraphdb
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/thundergolfer/simplegraphdb/simplesparql"
+)
+
+const xsdBoolean = "http://www.w3.org/2001/XMLSchema#boolean"
+
+// expressionScope is what an expression is evaluated against: the solution
+// binding its variables and, in a HAVING clause, the group of solutions its
+// aggregates are computed from
+type expressionScope struct {
+	sol   solution
+	group []solution
+}
+
+// functionArity gives the numbers of arguments each built in function takes
+var functionArity = map[string][]int{
+	"REGEX":     {2, 3},
+	"CONTAINS":  {2},
+	"STRSTARTS": {2},
+	"LANG":      {1},
+}
+
+// validateExpression checks that an expression only uses what can be
+// evaluated, and that its functions are given the right number of arguments.
+// Aggregates are only allowed in HAVING expressions
+func validateExpression(expr *simplesparql.Expression, allowAggregates bool) error {
+	for _, and := range expr.And {
+		for _, cond := range and.Or {
+			if err := validateCondition(cond, allowAggregates); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateCondition(cond *simplesparql.Condition, allowAggregates bool) error {
+	switch {
+	case cond.Not != nil:
+		return validateCondition(cond.Not, allowAggregates)
+	case cond.Operand == nil:
+		return fmt.Errorf("EXISTS isn't supported in expressions")
+	}
+
+	operands := []*simplesparql.Operand{cond.Operand.Operand}
+	if rhs := cond.Operand.ConditionRHS; rhs != nil {
+		switch {
+		case rhs.Compare != nil && rhs.Compare.Operand != nil:
+			operands = append(operands, rhs.Compare.Operand)
+		case rhs.In != nil && rhs.In.Select == nil:
+			for _, expr := range rhs.In.Expressions {
+				if err := validateExpression(expr, allowAggregates); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("Sub-queries aren't supported in expressions")
+		}
+	}
+
+	for _, operand := range operands {
+		summand := operand.Summand
+		factors := []*simplesparql.Factor{summand.LHS}
+		if summand.RHS != nil {
+			factors = append(factors, summand.RHS)
+		}
+		for _, factor := range factors {
+			if err := validateTerm(factor.LHS, allowAggregates); err != nil {
+				return err
+			}
+			if err := validateTerm(factor.RHS, allowAggregates); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateTerm(term *simplesparql.TripleTerm, allowAggregates bool) error {
+	var nested []*simplesparql.Expression
+	switch {
+	case term == nil:
+		return nil
+	case term.Aggregate != nil && !allowAggregates:
+		return fmt.Errorf("Aggregates can only be used in SELECT and HAVING expressions")
+	case term.SubExpression != nil:
+		nested = []*simplesparql.Expression{term.SubExpression}
+	case term.Value != nil && term.Value.Array != nil:
+		if len(term.Value.Array.Expressions) != 1 {
+			return fmt.Errorf("Lists aren't supported in expressions")
+		}
+		nested = term.Value.Array.Expressions
+	case term.Call != nil:
+		if !validateArity(term.Call) {
+			return fmt.Errorf("Wrong number of arguments given to %s", term.Call.Function)
+		}
+		nested = term.Call.Arguments
+	}
+
+	for _, expr := range nested {
+		if err := validateExpression(expr, allowAggregates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkExpressionTerms calls visit with each term of an expression which has
+// already been validated, including those nested in sub-expressions, lists
+// and function calls but not the variables aggregates are computed over
+func walkExpressionTerms(expr *simplesparql.Expression, visit func(*simplesparql.TripleTerm)) {
+	for _, and := range expr.And {
+		for _, cond := range and.Or {
+			for cond.Not != nil {
+				cond = cond.Not
+			}
+
+			operands := []*simplesparql.Operand{cond.Operand.Operand}
+			if rhs := cond.Operand.ConditionRHS; rhs != nil {
+				if rhs.Compare != nil {
+					operands = append(operands, rhs.Compare.Operand)
+				} else {
+					for _, nested := range rhs.In.Expressions {
+						walkExpressionTerms(nested, visit)
+					}
+				}
+			}
+
+			for _, operand := range operands {
+				for _, factor := range []*simplesparql.Factor{operand.Summand.LHS, operand.Summand.RHS} {
+					if factor == nil {
+						continue
+					}
+					walkTerm(factor.LHS, visit)
+					walkTerm(factor.RHS, visit)
+				}
+			}
+		}
+	}
+}
+
+func walkTerm(term *simplesparql.TripleTerm, visit func(*simplesparql.TripleTerm)) {
+	if term == nil {
+		return
+	}
+	visit(term)
+
+	var nested []*simplesparql.Expression
+	switch {
+	case term.SubExpression != nil:
+		nested = []*simplesparql.Expression{term.SubExpression}
+	case term.Value != nil && term.Value.Array != nil:
+		nested = term.Value.Array.Expressions
+	case term.Call != nil:
+		nested = term.Call.Arguments
+	}
+	for _, expr := range nested {
+		walkExpressionTerms(expr, visit)
+	}
+}
+
+func validateArity(call *simplesparql.FunctionCall) bool {
+	for _, n := range functionArity[call.Function] {
+		if len(call.Arguments) == n {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateExpression computes the term an expression gives for a scope. It
+// returns false when the expression has no value, such as when it uses an
+// unbound variable or adds a number to a string
+func evaluateExpression(expr *simplesparql.Expression, scope expressionScope) (Term, bool) {
+	if len(expr.And) == 1 {
+		return evaluateAndCondition(expr.And[0], scope)
+	}
+
+	// OR is true if any of its operands is true, even if others have no value
+	ok := true
+	for _, cond := range expr.And {
+		t, condOk := evaluateAndCondition(cond, scope)
+		b, boolOk := effectiveBooleanValue(t)
+		switch {
+		case condOk && boolOk && b:
+			return newBoolean(true), true
+		case !condOk || !boolOk:
+			ok = false
+		}
+	}
+	return newBoolean(false), ok
+}
+
+func evaluateAndCondition(cond *simplesparql.AndCondition, scope expressionScope) (Term, bool) {
+	if len(cond.Or) == 1 {
+		return evaluateCondition(cond.Or[0], scope)
+	}
+
+	// AND is false if any of its operands is false, even if others have no value
+	ok := true
+	for _, c := range cond.Or {
+		t, condOk := evaluateCondition(c, scope)
+		b, boolOk := effectiveBooleanValue(t)
+		switch {
+		case condOk && boolOk && !b:
+			return newBoolean(false), true
+		case !condOk || !boolOk:
+			ok = false
+		}
+	}
+	return newBoolean(true), ok
+}
+
+func evaluateCondition(cond *simplesparql.Condition, scope expressionScope) (Term, bool) {
+	switch {
+	case cond.Operand != nil:
+		return evaluateConditionOperand(cond.Operand, scope)
+	case cond.Not != nil:
+		t, ok := evaluateCondition(cond.Not, scope)
+		if !ok {
+			return Term{}, false
+		}
+		b, ok := effectiveBooleanValue(t)
+		return newBoolean(!b), ok
+	}
+	return Term{}, false // EXISTS isn't supported
+}
+
+func evaluateConditionOperand(cond *simplesparql.ConditionOperand, scope expressionScope) (Term, bool) {
+	lhs, ok := evaluateOperand(cond.Operand, scope)
+	if !ok || cond.ConditionRHS == nil {
+		return lhs, ok
+	}
+
+	if compare := cond.ConditionRHS.Compare; compare != nil {
+		if compare.Operand == nil {
+			return Term{}, false // comparing with a sub-select isn't supported
+		}
+		rhs, ok := evaluateOperand(compare.Operand, scope)
+		if !ok {
+			return Term{}, false
+		}
+		return compareValues(compare.Operator, lhs, rhs)
+	}
+
+	in := cond.ConditionRHS.In
+	if in.Select != nil {
+		return Term{}, false
+	}
+	found, ok := false, true
+	for _, expr := range in.Expressions {
+		rhs, rhsOk := evaluateExpression(expr, scope)
+		if !rhsOk {
+			ok = false
+			continue
+		}
+		if equal, _ := compareValues("=", lhs, rhs); equal.Value == "true" {
+			found = true
+		}
+	}
+	return newBoolean(found), found || ok
+}
+
+func evaluateOperand(operand *simplesparql.Operand, scope expressionScope) (Term, bool) {
+	return evaluateSummand(operand.Summand, scope)
+}
+
+func evaluateSummand(summand *simplesparql.Summand, scope expressionScope) (Term, bool) {
+	lhs, ok := evaluateFactor(summand.LHS, scope)
+	if !ok || summand.Op == "" {
+		return lhs, ok
+	}
+	rhs, ok := evaluateFactor(summand.RHS, scope)
+	if !ok {
+		return Term{}, false
+	}
+	return arithmetic(summand.Op, lhs, rhs)
+}
+
+func evaluateFactor(factor *simplesparql.Factor, scope expressionScope) (Term, bool) {
+	lhs, ok := evaluateTerm(factor.LHS, scope)
+	if !ok || factor.Op == "" {
+		return lhs, ok
+	}
+	rhs, ok := evaluateTerm(factor.RHS, scope)
+	if !ok {
+		return Term{}, false
+	}
+	return arithmetic(factor.Op, lhs, rhs)
+}
+
+func evaluateTerm(term *simplesparql.TripleTerm, scope expressionScope) (Term, bool) {
+	switch {
+	case term.Var != "":
+		val, ok := scope.sol[term.Var]
+		return ParseTerm(val), ok
+	case term.Aggregate != nil:
+		if scope.group == nil {
+			return Term{}, false
+		}
+		return computeAggregate(term.Aggregate, scope.group)
+	case term.SubExpression != nil:
+		return evaluateExpression(term.SubExpression, scope)
+	case term.Call != nil:
+		return evaluateFunctionCall(term.Call, scope)
+	case term.IRI != "":
+		return ParseTerm(tripleTermString(term)), true
+	case term.Value == nil:
+		return Term{}, false
+	}
+
+	t, ok := evaluateValue(term, scope)
+	if !ok || !term.Value.Negated {
+		return t, ok
+	}
+
+	// a minus sign negates a number, and anything else has no value
+	n, ok := numericValue(t)
+	if !ok {
+		return Term{}, false
+	}
+	return newNumber(-n), true
+}
+
+// evaluateValue computes a constant or parenthesised expression, ignoring any
+// minus sign before it
+func evaluateValue(term *simplesparql.TripleTerm, scope expressionScope) (Term, bool) {
+	value := term.Value
+	switch {
+	case value.String != nil:
+		return ParseTerm(tripleTermString(term)), true
+	case value.Number != nil:
+		return newNumber(*value.Number), true
+	case value.Boolean != nil:
+		return newBoolean(bool(*value.Boolean)), true
+	case value.Array != nil && len(value.Array.Expressions) == 1:
+		// a parenthesised expression
+		return evaluateExpression(value.Array.Expressions[0], scope)
+	}
+	return Term{}, false
+}
+
+// evaluateFunctionCall computes a built in function. Its arguments must be
+// literals, and are matched by their values, ignoring any language or datatype
+func evaluateFunctionCall(call *simplesparql.FunctionCall, scope expressionScope) (Term, bool) {
+	args := make([]Term, len(call.Arguments))
+	for i, expr := range call.Arguments {
+		arg, ok := evaluateExpression(expr, scope)
+		if !ok || arg.Kind != LiteralTerm {
+			return Term{}, false
+		}
+		args[i] = arg
+	}
+
+	switch call.Function {
+	case "REGEX":
+		pattern := args[1].Value
+		if len(args) == 3 && args[2].Value != "" {
+			pattern = "(?" + args[2].Value + ")" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return Term{}, false
+		}
+		return newBoolean(re.MatchString(args[0].Value)), true
+	case "CONTAINS":
+		return newBoolean(strings.Contains(args[0].Value, args[1].Value)), true
+	case "STRSTARTS":
+		return newBoolean(strings.HasPrefix(args[0].Value, args[1].Value)), true
+	case "LANG":
+		return NewLiteral(args[0].Lang), true
+	}
+	return Term{}, false
+}
+
+// compareValues compares numbers by value and other terms as terms. Only
+// numbers and literals can be ordered
+func compareValues(operator string, lhs, rhs Term) (Term, bool) {
+	lhsNum, lhsIsNum := numericValue(lhs)
+	rhsNum, rhsIsNum := numericValue(rhs)
+
+	var c int
+	switch {
+	case lhsIsNum && rhsIsNum:
+		c = compareTerms(lhs, rhs)
+		if lhsNum == rhsNum {
+			c = 0
+		}
+	case operator == "=":
+		return newBoolean(lhs == rhs), true
+	case operator == "!=" || operator == "<>":
+		return newBoolean(lhs != rhs), true
+	case lhs.Kind == LiteralTerm && rhs.Kind == LiteralTerm && !lhsIsNum && !rhsIsNum:
+		c = compareTerms(lhs, rhs)
+	default:
+		return Term{}, false
+	}
+
+	switch operator {
+	case "=":
+		return newBoolean(c == 0), true
+	case "!=", "<>":
+		return newBoolean(c != 0), true
+	case "<":
+		return newBoolean(c < 0), true
+	case "<=":
+		return newBoolean(c <= 0), true
+	case ">":
+		return newBoolean(c > 0), true
+	case ">=":
+		return newBoolean(c >= 0), true
+	}
+	return Term{}, false
+}
+
+func arithmetic(operator string, lhs, rhs Term) (Term, bool) {
+	a, aOk := numericValue(lhs)
+	b, bOk := numericValue(rhs)
+	if !aOk || !bOk {
+		return Term{}, false
+	}
+
+	switch operator {
+	case "+":
+		return newNumber(a + b), true
+	case "-":
+		return newNumber(a - b), true
+	case "*":
+		return newNumber(a * b), true
+	case "/":
+		if b == 0 {
+			return Term{}, false
+		}
+		return newNumber(a / b), true
+	case "%":
+		if b == 0 {
+			return Term{}, false
+		}
+		return newNumber(math.Mod(a, b)), true
+	}
+	return Term{}, false
+}
+
+// newNumber gives a number as a plain literal, in the same form the store
+// holds numbers loaded from files
+func newNumber(n float64) Term {
+	return NewLiteral(strconv.FormatFloat(n, 'f', -1, 64))
+}
+
+func newBoolean(b bool) Term {
+	return NewTypedLiteral(strconv.FormatBool(b), xsdBoolean)
+}
+
+// effectiveBooleanValue gives whether a term counts as true in a condition.
+// Booleans are themselves, numbers are true unless zero and other literals
+// are true unless empty. IRIs and blank nodes have no boolean value
+func effectiveBooleanValue(t Term) (bool, bool) {
+	if t.Kind != LiteralTerm {
+		return false, false
+	}
+	if t.Datatype == xsdBoolean {
+		b, err := strconv.ParseBool(t.Value)
+		return b, err == nil
+	}
+	if n, ok := numericValue(t); ok {
+		return n != 0, true
+	}
+	return t.Value != "", true
+}
@@ -0,0 +1,277 @@
+package simplegraphdb
+
+import "sort"
+
+// NamedGraphs is implemented by stores which keep named graphs of triples apart
+// from their default graph. simplesparql GRAPH blocks are matched against them
+type NamedGraphs interface {
+	Graph(name string) (Hexastore, bool)
+	GraphNames() []string
+}
+
+// rootGraph finds the default graph of a store
+func (store *HexastoreDB) rootGraph() *HexastoreDB {
+	if store.root != nil {
+		return store.root
+	}
+	return store
+}
+
+// namedGraph finds a named graph, creating it if needed. The caller must hold the write lock
+func (store *HexastoreDB) namedGraph(name string) *HexastoreDB {
+	return store.graphWithID(store.entities.Put(name))
+}
+
+// graphWithID finds the named graph whose name has an entity ID, creating it if
+// needed. The caller must hold the write lock
+func (store *HexastoreDB) graphWithID(id int) *HexastoreDB {
+	root := store.rootGraph()
+
+	graph, ok := root.graphs[id]
+	if !ok {
+		graph = newIndexes(root.entities, root.props, root.mu)
+		graph.root = root
+		root.graphs[id] = graph
+	}
+
+	return graph
+}
+
+// AddQuad introduces a new triple of plain literals into a named graph of the
+// hexastore database, creating the graph if needed. The graph is named as
+// Graph names it
+func (store *HexastoreDB) AddQuad(subject, property, object, value, graph string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.apply(txOp{subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object), value: value, graph: graph})
+}
+
+// Graph finds a named graph of the store. Queries and updates made through it are
+// scoped to that graph, and its IDs are shared with the rest of the store
+func (store *HexastoreDB) Graph(name string) (Hexastore, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	root := store.rootGraph()
+	id, ok := root.entities.GetKey(name)
+	if !ok {
+		return nil, false
+	}
+
+	graph, ok := root.graphs[id]
+	if !ok {
+		return nil, false
+	}
+	return graph, true
+}
+
+// GraphNames lists, in order, the names of the store's named graphs which hold any triples
+func (store *HexastoreDB) GraphNames() []string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	root := store.rootGraph()
+	names := []string{}
+	for id, graph := range root.graphs {
+		if len(graph.SPO) > 0 {
+			name, _ := root.entities.Get(id)
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Union gives a view of the store which queries the union of its default graph
+// and every named graph. Updates made through the view go to the default graph
+func (store *HexastoreDB) Union() Hexastore {
+	return &unionGraph{store: store.rootGraph(), defaultGraph: store.rootGraph()}
+}
+
+type unionGraph struct {
+	store        *HexastoreDB
+	defaultGraph Hexastore
+}
+
+// graphs lists the default graph followed by every named graph, in ID order
+func (u *unionGraph) graphs() []*HexastoreDB {
+	u.store.mu.RLock()
+	defer u.store.mu.RUnlock()
+
+	ids := []int{}
+	for id := range u.store.graphs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	graphs := []*HexastoreDB{u.store}
+	for _, id := range ids {
+		graphs = append(graphs, u.store.graphs[id])
+	}
+	return graphs
+}
+
+// query runs a query against every graph, dropping triples already found in an
+// earlier graph so that the union is a set. Each graph is read under its own
+// lock, so updates made part way through a union query may be only partly seen
+func (u *unionGraph) query(q func(graph *HexastoreDB) *[]Triple) *[]Triple {
+	res := []Triple{}
+	seen := map[[3]int]bool{}
+
+	for _, graph := range u.graphs() {
+		for _, t := range *q(graph) {
+			key := [3]int{t.Subject, t.Prop, t.Object}
+			if !seen[key] {
+				seen[key] = true
+				res = append(res, t)
+			}
+		}
+	}
+
+	return &res
+}
+
+func (u *unionGraph) QueryXXX() *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QueryXXX() })
+}
+
+func (u *unionGraph) QuerySXX(subjID int) *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QuerySXX(subjID) })
+}
+
+func (u *unionGraph) QueryXPX(propID int) *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QueryXPX(propID) })
+}
+
+func (u *unionGraph) QueryXXO(objID int) *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QueryXXO(objID) })
+}
+
+func (u *unionGraph) QuerySPX(subjID, propID int) *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QuerySPX(subjID, propID) })
+}
+
+func (u *unionGraph) QuerySXO(subjID, objID int) *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QuerySXO(subjID, objID) })
+}
+
+func (u *unionGraph) QueryXPO(propID, objID int) *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QueryXPO(propID, objID) })
+}
+
+func (u *unionGraph) QuerySPO(subjID, propID, objID int) *[]Triple {
+	return u.query(func(g *HexastoreDB) *[]Triple { return g.QuerySPO(subjID, propID, objID) })
+}
+
+func (u *unionGraph) GetPropKey(val string) (int, bool) { return u.store.GetPropKey(val) }
+
+func (u *unionGraph) GetEntityKey(val string) (int, bool) { return u.store.GetEntityKey(val) }
+
+func (u *unionGraph) ResolveEntity(id int) string { return u.store.ResolveEntity(id) }
+
+func (u *unionGraph) ResolveProp(id int) string { return u.store.ResolveProp(id) }
+
+func (u *unionGraph) Add(subject, property, object, value string) {
+	u.defaultGraph.Add(subject, property, object, value)
+}
+
+func (u *unionGraph) Remove(subject, property, object string) bool {
+	return u.defaultGraph.Remove(subject, property, object)
+}
+
+func (u *unionGraph) RemoveMatching(subject, property, object string) int {
+	return u.defaultGraph.RemoveMatching(subject, property, object)
+}
+
+func (u *unionGraph) Begin() Tx {
+	return u.defaultGraph.Begin()
+}
+
+// unionIterator walks each graph's matches in turn, skipping triples already
+// found in an earlier graph
+type unionIterator struct {
+	graphs  []*HexastoreDB
+	iter    func(graph *HexastoreDB) TripleIterator
+	sub     TripleIterator
+	seen    map[[3]int]bool
+	current Triple
+}
+
+func (u *unionGraph) iterate(iter func(graph *HexastoreDB) TripleIterator) TripleIterator {
+	return &unionIterator{graphs: u.graphs(), iter: iter, seen: map[[3]int]bool{}}
+}
+
+func (it *unionIterator) Next() bool {
+	for {
+		if it.sub != nil && it.sub.Next() {
+			t := it.sub.Triple()
+			key := [3]int{t.Subject, t.Prop, t.Object}
+			if !it.seen[key] {
+				it.seen[key] = true
+				it.current = t
+				return true
+			}
+			continue
+		}
+
+		if it.sub != nil && it.sub.Err() != nil {
+			return false
+		}
+		if len(it.graphs) == 0 {
+			return false
+		}
+		it.sub = it.iter(it.graphs[0])
+		it.graphs = it.graphs[1:]
+	}
+}
+
+func (it *unionIterator) Triple() Triple { return it.current }
+
+func (it *unionIterator) Err() error {
+	if it.sub != nil {
+		return it.sub.Err()
+	}
+	return nil
+}
+
+func (it *unionIterator) Close() error {
+	it.graphs = nil
+	if it.sub != nil {
+		return it.sub.Close()
+	}
+	return nil
+}
+
+func (u *unionGraph) IterXXX() TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterXXX() })
+}
+
+func (u *unionGraph) IterSXX(subjID int) TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterSXX(subjID) })
+}
+
+func (u *unionGraph) IterXPX(propID int) TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterXPX(propID) })
+}
+
+func (u *unionGraph) IterXXO(objID int) TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterXXO(objID) })
+}
+
+func (u *unionGraph) IterSPX(subjID, propID int) TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterSPX(subjID, propID) })
+}
+
+func (u *unionGraph) IterSXO(subjID, objID int) TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterSXO(subjID, objID) })
+}
+
+func (u *unionGraph) IterXPO(propID, objID int) TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterXPO(propID, objID) })
+}
+
+func (u *unionGraph) IterSPO(subjID, propID, objID int) TripleIterator {
+	return u.iterate(func(g *HexastoreDB) TripleIterator { return g.IterSPO(subjID, propID, objID) })
+}
@@ -0,0 +1,191 @@
+package simplegraphdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func createTestNamedGraphs() *HexastoreDB {
+	h := newHexastore()
+
+	h.Add("alice", "knows", "bob", "")
+	h.AddQuad("alice", "follows", "bob", "", "twitter")
+	h.AddQuad("bob", "follows", "carol", "", "twitter")
+	h.AddQuad("alice", "knows", "bob", "", "work")
+	h.AddQuad("carol", "manages", "alice", "", "work")
+
+	return h
+}
+
+func TestNamedGraphs(t *testing.T) {
+	h := createTestNamedGraphs()
+
+	if diff := deep.Equal(h.GraphNames(), []string{"twitter", "work"}); diff != nil {
+		t.Error(diff)
+	}
+	if len(*h.QueryXXX()) != 1 {
+		t.Errorf("Expected 1 triple in the default graph, got %d", len(*h.QueryXXX()))
+	}
+
+	twitter, ok := h.Graph("twitter")
+	if !ok {
+		t.Fatal("Expected to find graph 'twitter'")
+	}
+	if len(*twitter.QueryXXX()) != 2 {
+		t.Errorf("Expected 2 triples in graph 'twitter', got %d", len(*twitter.QueryXXX()))
+	}
+	if _, ok := h.Graph("facebook"); ok {
+		t.Error("Expected graph 'facebook' not to exist")
+	}
+
+	// the union drops the triple held by both the default graph and 'work'
+	if n := len(*h.Union().QueryXXX()); n != 4 {
+		t.Errorf("Expected 4 triples in the union of all graphs, got %d", n)
+	}
+
+	// emptied graphs are no longer listed
+	twitter.RemoveMatching("?s", "?p", "?o")
+	if diff := deep.Equal(h.GraphNames(), []string{"work"}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func Test_runQueryWithGraphPatterns(t *testing.T) {
+	hexastore := createTestNamedGraphs()
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			comment: "named graph",
+			query:   "SELECT ?x, ?y WHERE { GRAPH 'twitter' { ?x 'follows' ?y } }",
+			expected: [][]string{
+				[]string{"?x", "?y"},
+				[]string{"alice", "bob"},
+				[]string{"bob", "carol"},
+			},
+		},
+		{
+			comment: "default graph doesn't see named graphs",
+			query:   "SELECT ?x WHERE { ?x 'manages' 'alice' }",
+			expected: [][]string{
+				[]string{"?x"},
+			},
+		},
+		{
+			comment: "graph variable",
+			query:   "SELECT ?g, ?y WHERE { GRAPH ?g { 'alice' ?p ?y } }",
+			expected: [][]string{
+				[]string{"?g", "?y"},
+				[]string{"twitter", "bob"},
+				[]string{"work", "bob"},
+			},
+		},
+		{
+			comment: "join between the default graph and a named graph",
+			query:   "SELECT ?x, ?y WHERE { ?x 'knows' ?y . GRAPH 'work' { ?z 'manages' ?x } }",
+			expected: [][]string{
+				[]string{"?x", "?y"},
+				[]string{"alice", "bob"},
+			},
+		},
+		{
+			comment: "unknown graph",
+			query:   "SELECT ?x WHERE { GRAPH 'facebook' { ?x ?p ?y } }",
+			expected: [][]string{
+				[]string{"?x"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		results, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", c.comment, err)
+			continue
+		}
+		if len(results) != len(c.expected) || !checkResultsEquality(results, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.comment, c.expected, results)
+		}
+	}
+}
+
+func TestNamedGraphsPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := createTestNamedGraphs()
+	expected := dumpHexastore(original)
+
+	jsonPath := filepath.Join(dir, "db.json")
+	if err := SaveToJSONRows(jsonPath, original); err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := InitHexastoreFromJSONRows(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(expected, dumpHexastore(fromJSON)); diff != nil {
+		t.Error("JSON rows: ", diff)
+	}
+
+	snapshotPath := filepath.Join(dir, "db.snapshot")
+	if err := SaveSnapshot(snapshotPath, original); err != nil {
+		t.Fatal(err)
+	}
+	fromSnapshot, err := InitHexastoreFromSnapshot(snapshotPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(expected, dumpHexastore(fromSnapshot)); diff != nil {
+		t.Error("snapshot: ", diff)
+	}
+}
+
+func TestDurableHexastoreReplaysNamedGraphs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "knows", "bob", "")
+	store.AddQuad("alice", "follows", "bob", "", "twitter")
+	store.AddQuad("bob", "follows", "carol", "", "twitter")
+
+	twitter, _ := store.Graph("twitter")
+	twitter.Remove("alice", "follows", "bob")
+	tx := twitter.Begin()
+	tx.Add("carol", "follows", "alice", "")
+	tx.Commit()
+
+	expected := dumpHexastore(store)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if len(expected.Triples) != 3 {
+		t.Errorf("Expected 3 triples in the store, got %v", expected.Triples)
+	}
+	if diff := deep.Equal(expected, dumpHexastore(reopened)); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
 
 	"github.com/thundergolfer/turtle" // TODO: use fork until my PR is merged to handle RDF 'Bags'
 )
@@ -25,45 +27,93 @@ func toJSON(db interface{}) string {
 }
 
 type tripleDb struct {
-	Triples []Entry
+	Triples []Entry `json:"triples"`
 }
 
 // Entry is a type used as an intermediary between
 // a plaintext/JSON representation of a triple and the
-// ID based presentation loaded into the Hexastore
+// ID based presentation loaded into the Hexastore.
+// Its terms are in the form written by Term.String
 type Entry struct {
-	Subject string
-	Prop    string
-	Object  string
+	Subject string `json:"subject"`
+	Prop    string `json:"prop"`
+	Object  string `json:"object"`
+	Value   string `json:"value,omitempty"`
+	Graph   string `json:"graph,omitempty"`
+}
+
+// UnmarshalJSON reads an Entry, taking a number or boolean value, eg.
+// "value": 0.5, as the text it's written with
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	type entry Entry
+	var raw struct {
+		entry
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*e = Entry(raw.entry)
+	switch {
+	case len(raw.Value) == 0 || string(raw.Value) == "null":
+	case raw.Value[0] == '"':
+		return json.Unmarshal(raw.Value, &e.Value)
+	case raw.Value[0] == '{' || raw.Value[0] == '[':
+		return fmt.Errorf("triple value must be a string, number or boolean, got %s", raw.Value)
+	default:
+		e.Value = string(raw.Value)
+	}
+	return nil
 }
 
 // Dictionary is only exported because it's currently tested
 // TODO remove need to export this
+//
+// It maps in both directions between terms and their int IDs so that
+// lookups either way don't need to scan the dictionary. Its string methods
+// work with terms in the form written by Term.String
 type Dictionary struct {
-	m       map[int]string
+	m       map[int]Term
+	keys    map[Term]int
 	NextKey int
 }
 
-// GetKey provides access to the Dictionary's map, returning the
+func newDictionary() Dictionary {
+	return Dictionary{m: make(map[int]Term), keys: make(map[Term]int)}
+}
+
+// GetKey provides access to the Dictionary's reverse map, returning the
 // int ID for a given string val, or (0, false) if the string is not
 // in the dictionary
 func (dict Dictionary) GetKey(val string) (key int, ok bool) {
-	for k, v := range dict.m {
-		if v == val {
-			return k, true
-		}
-	}
+	return dict.GetTermKey(ParseTerm(val))
+}
 
-	return 0, false
+// GetTermKey returns the int ID of a term, or (0, false) if the term
+// is not in the dictionary
+func (dict Dictionary) GetTermKey(t Term) (key int, ok bool) {
+	key, ok = dict.keys[t]
+	return
 }
 
-// Put adds a new string value into the Dictionary.
-// Warning: should not be called with the same string twice,
-// because that string will get 2 IDs
+// Put adds a term, in the form written by Term.String, into the Dictionary and
+// returns its ID. Putting a term that's already in the dictionary returns its
+// existing ID
 func (dict *Dictionary) Put(val string) (key int) {
-	// Don't call without checking that value doesn't already exist
-	dict.m[dict.NextKey] = val
+	return dict.PutTerm(ParseTerm(val))
+}
+
+// PutTerm adds a term into the Dictionary and returns its ID, which is
+// its existing ID if it's already in the dictionary
+func (dict *Dictionary) PutTerm(t Term) (key int) {
+	if key, ok := dict.keys[t]; ok {
+		return key
+	}
+
 	key = dict.NextKey
+	dict.m[key] = t
+	dict.keys[t] = key
 	dict.NextKey++
 	return
 }
@@ -72,7 +122,16 @@ func (dict *Dictionary) Put(val string) (key int) {
 // access the given key in that map
 // ie. basically a middleman method
 func (dict Dictionary) Get(key int) (val string, ok bool) {
-	val, ok = dict.m[key]
+	t, ok := dict.m[key]
+	if !ok {
+		return "", false
+	}
+	return t.String(), true
+}
+
+// GetTerm returns the term with a given ID
+func (dict Dictionary) GetTerm(key int) (t Term, ok bool) {
+	t, ok = dict.m[key]
 	return
 }
 
@@ -88,17 +147,13 @@ type PropDict struct {
 
 // NewEntityDict creates and initialises a new EntityDict
 func NewEntityDict() *EntityDict {
-	var eD EntityDict
-	eD.m = make(map[int]string)
-	eD.NextKey = 0
+	eD := EntityDict{newDictionary()}
 	return &eD
 }
 
 // NewPropDict creates and initialises and new PropDict
 func NewPropDict() *PropDict {
-	var pD PropDict
-	pD.m = make(map[int]string)
-	pD.NextKey = 0
+	pD := PropDict{newDictionary()}
 	return &pD
 }
 
@@ -113,7 +168,18 @@ type Hexastore interface {
 	QuerySXO(subjID, objID int) *[]Triple
 	QueryXPO(propID, objID int) *[]Triple
 	QuerySPO(subjID, propID, objID int) *[]Triple
+	IterXXX() TripleIterator
+	IterSXX(subjID int) TripleIterator
+	IterXPX(propID int) TripleIterator
+	IterXXO(objID int) TripleIterator
+	IterSPX(subjID, propID int) TripleIterator
+	IterSXO(subjID, objID int) TripleIterator
+	IterXPO(propID, objID int) TripleIterator
+	IterSPO(subjID, propID, objID int) TripleIterator
 	Add(subject, property, object, value string)
+	Remove(subject, property, object string) bool
+	RemoveMatching(subject, property, object string) int
+	Begin() Tx
 	GetPropKey(val string) (key int, ok bool)
 	GetEntityKey(val string) (key int, ok bool)
 	ResolveEntity(id int) string
@@ -121,7 +187,8 @@ type Hexastore interface {
 }
 
 // HexastoreDB is the triple-store data structure
-// driving the database
+// driving the database. Its methods are safe for concurrent use, but the
+// exported indexes are not guarded when accessed directly
 type HexastoreDB struct {
 	SPO      map[int]map[int]map[int]string
 	SOP      map[int]map[int]map[int]string
@@ -131,9 +198,23 @@ type HexastoreDB struct {
 	OPS      map[int]map[int]map[int]string
 	entities *EntityDict
 	props    *PropDict
+	mu       *sync.RWMutex
+
+	// graphs holds the named graphs of a default graph, keyed by the entity ID
+	// of their name. A named graph shares the dictionaries and lock of its
+	// default graph, which it points to with root
+	graphs map[int]*HexastoreDB
+	root   *HexastoreDB
 }
 
 func newHexastore() *HexastoreDB {
+	store := newIndexes(NewEntityDict(), NewPropDict(), &sync.RWMutex{})
+	store.graphs = make(map[int]*HexastoreDB)
+
+	return store
+}
+
+func newIndexes(entities *EntityDict, props *PropDict, mu *sync.RWMutex) *HexastoreDB {
 	var store HexastoreDB
 	store.SPO = make(map[int]map[int]map[int]string)
 	store.SOP = make(map[int]map[int]map[int]string)
@@ -141,8 +222,9 @@ func newHexastore() *HexastoreDB {
 	store.POS = make(map[int]map[int]map[int]string)
 	store.OSP = make(map[int]map[int]map[int]string)
 	store.OPS = make(map[int]map[int]map[int]string)
-	store.entities = NewEntityDict()
-	store.props = NewPropDict()
+	store.entities = entities
+	store.props = props
+	store.mu = mu
 
 	return &store
 }
@@ -165,6 +247,9 @@ func MakeTriple(subject, prop, object int, value string) *Triple {
 // PresentableResults converts a slice of Triple objects to a slice of strings with
 // triple component IDs converted to their string value
 func PresentableResults(results *[]Triple, hexastore *HexastoreDB) *[]string {
+	hexastore.mu.RLock()
+	defer hexastore.mu.RUnlock()
+
 	presentables := []string{}
 	for _, triple := range *results {
 		presentables = append(presentables, PresentTriple(&triple, hexastore.props, hexastore.entities))
@@ -177,40 +262,84 @@ func PresentableResults(results *[]Triple, hexastore *HexastoreDB) *[]string {
 // two dictionaries are needed
 // TODO refactor to use store.Resolve*() methods
 func PresentTriple(t *Triple, props *PropDict, entities *EntityDict) string {
-	return fmt.Sprintf("%s -> %s -> %s", entities.m[t.Subject], props.m[t.Prop], entities.m[t.Object])
+	return fmt.Sprintf("%s -> %s -> %s", entities.m[t.Subject].String(), props.m[t.Prop].String(), entities.m[t.Object].String())
 }
 
 // GetPropKey finds the integer id for a particular string value which is a property
 func (store *HexastoreDB) GetPropKey(val string) (int, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	return store.props.GetKey(val)
 }
 
 // GetEntityKey finds the integer id for a particular string value which is an entity (object or subject)
 func (store *HexastoreDB) GetEntityKey(val string) (int, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	return store.entities.GetKey(val)
 }
 
 // ResolveEntity finds the string value for a given entity ID
 func (store *HexastoreDB) ResolveEntity(id int) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	val, _ := store.entities.Get(id)
 	return val
 }
 
 // ResolveProp finds the string value for a given property ID
 func (store *HexastoreDB) ResolveProp(id int) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	val, _ := store.props.Get(id)
 	return val
 }
 
-// Add introduces a new triple into the hexastore database
+// ResolveEntityTerm finds the term for a given entity ID
+func (store *HexastoreDB) ResolveEntityTerm(id int) Term {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	t, _ := store.entities.GetTerm(id)
+	return t
+}
+
+// ResolvePropTerm finds the term for a given property ID
+func (store *HexastoreDB) ResolvePropTerm(id int) Term {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	t, _ := store.props.GetTerm(id)
+	return t
+}
+
+// AddTerms introduces a new triple of terms into the hexastore database
+func (store *HexastoreDB) AddTerms(subject, property, object Term, value string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.apply(txOp{subject: subject.String(), property: property.String(), object: object.String(), value: value})
+}
+
+// Add introduces a new triple into the hexastore database. Its strings are
+// stored as plain literals, whatever they hold, so IRIs, blank nodes and
+// tagged literals are added with AddTerms
 func (store *HexastoreDB) Add(subject, property, object, value string) {
-	subjectID, propID, objectID := store.MapStringsToIds(subject, property, object)
-	triple := MakeTriple(subjectID, propID, objectID, value)
-	store.add(triple)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.apply(txOp{subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object), value: value})
 }
 
 // MapIdsToStrings finds the string values for each component ID of a triple
 func (store *HexastoreDB) MapIdsToStrings(subjID, propID, objectID int) (string, string, string) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	subject, _ := store.entities.Get(subjID)
 	object, _ := store.entities.Get(objectID)
 	prop, _ := store.props.Get(propID)
@@ -221,22 +350,14 @@ func (store *HexastoreDB) MapIdsToStrings(subjID, propID, objectID int) (string,
 // MapStringsToIds finds the IDs for each string value of a triple, and creates and entry and returns
 // the new ID if a string value doesn't already exist
 func (store *HexastoreDB) MapStringsToIds(subject, property, object string) (int, int, int) {
-	var ok bool
-	var objID, subjID, propID int
-	subjID, ok = store.entities.GetKey(subject)
-	if !ok {
-		subjID = store.entities.Put(subject)
-	}
-	propID, ok = store.props.GetKey(property)
-	if !ok {
-		propID = store.props.Put(property)
-	}
-	objID, ok = store.entities.GetKey(object)
-	if !ok {
-		objID = store.entities.Put(object)
-	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
 
-	return subjID, propID, objID
+	return store.mapStringsToIds(subject, property, object)
+}
+
+func (store *HexastoreDB) mapStringsToIds(subject, property, object string) (int, int, int) {
+	return store.entities.Put(subject), store.props.Put(property), store.entities.Put(object)
 }
 
 func (store *HexastoreDB) add(t *Triple) {
@@ -287,24 +408,74 @@ func (store *HexastoreDB) add(t *Triple) {
 	}
 }
 
-func (store *HexastoreDB) remove(t *Triple) {
-	var s, p, o int = t.Subject, t.Prop, t.Object
-	var subjectIndx = store.SPO
-	var pred = subjectIndx[s]
-
-	if pred != nil {
-		var obj = pred[p]
-		if obj != nil {
-			if _, ok := obj[o]; ok {
-				delete(store.SPO[s][p], o)
-				delete(store.SOP[s][o], p)
-				delete(store.PSO[p][s], o)
-				delete(store.POS[p][o], s)
-				delete(store.OSP[o][s], p)
-				delete(store.OPS[o][p], s)
-			}
+// Remove deletes a triple of plain literals from the hexastore database,
+// returning false if the triple wasn't in the store
+func (store *HexastoreDB) Remove(subject, property, object string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.apply(txOp{remove: true, subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object)})
+}
+
+// RemoveMatching deletes every triple matching a pattern in which simplesparql
+// variables (eg. "?x") act as wildcards and other strings are plain literals,
+// returning the number of triples removed. Matches are collected before any
+// are removed, so triples added concurrently with the call may survive it
+func (store *HexastoreDB) RemoveMatching(subject, property, object string) int {
+	subject, property, object = plainLiteralPattern(subject, property, object)
+	matches := retreiveQueryResults(subject, property, object, store)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	removed := 0
+	for i := range *matches {
+		if store.remove(&(*matches)[i]) {
+			removed++
 		}
 	}
+
+	return removed
+}
+
+func (store *HexastoreDB) remove(t *Triple) bool {
+	var s, p, o int = t.Subject, t.Prop, t.Object
+
+	if _, ok := store.SPO[s][p][o]; !ok {
+		return false
+	}
+
+	delete(store.SPO[s][p], o)
+	delete(store.SOP[s][o], p)
+	delete(store.PSO[p][s], o)
+	delete(store.POS[p][o], s)
+	delete(store.OSP[o][s], p)
+	delete(store.OPS[o][p], s)
+
+	pruneIndexes(store.SPO, store.PSO, s, p)
+	pruneIndexes(store.SOP, store.OSP, s, o)
+	pruneIndexes(store.POS, store.OPS, p, o)
+
+	return true
+}
+
+// pruneIndexes drops the innermost map shared by a pair of mirrored indexes
+// (eg. SPO[s][p] and PSO[p][s]) once it's empty, along with any outer level
+// left empty as a result, so that churning edges doesn't leak memory
+func pruneIndexes(index, mirror map[int]map[int]map[int]string, first, second int) {
+	if len(index[first][second]) > 0 {
+		return
+	}
+
+	delete(index[first], second)
+	if len(index[first]) == 0 {
+		delete(index, first)
+	}
+
+	delete(mirror[second], first)
+	if len(mirror[second]) == 0 {
+		delete(mirror, second)
+	}
 }
 
 /*
@@ -313,6 +484,9 @@ func (store *HexastoreDB) remove(t *Triple) {
 
 // QuerySXX allows for querying the hexastore specifying only a Subject entity ID
 func (store *HexastoreDB) QuerySXX(subjID int) *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	res := []Triple{}
 	relevant := store.SPO[subjID]
 
@@ -333,6 +507,9 @@ func (store *HexastoreDB) QuerySXX(subjID int) *[]Triple {
 // QuerySPX allows for querying the hexastore specifying only a Subject entity ID
 // and a Property ID
 func (store *HexastoreDB) QuerySPX(subjID, propID int) *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	res := []Triple{}
 	relevant := store.SPO[subjID]
 
@@ -353,11 +530,31 @@ func (store *HexastoreDB) QuerySPX(subjID, propID int) *[]Triple {
 // QuerySXO allows for querying the hexastore specifying only a Subject entity ID
 // and an Object entity ID
 func (store *HexastoreDB) QuerySXO(subjID, objID int) *[]Triple {
-	return &[]Triple{}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	res := []Triple{}
+	relevant := store.SOP[subjID]
+
+	if relevant == nil {
+		return &[]Triple{}
+	}
+
+	properties := relevant[objID]
+
+	for propID, value := range properties {
+		currTriple := MakeTriple(subjID, propID, objID, value)
+		res = append(res, *currTriple)
+	}
+
+	return &res
 }
 
 // QueryXPX allows for querying the hexastore specifying only a Property ID
 func (store *HexastoreDB) QueryXPX(propID int) *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	res := []Triple{}
 	relevant := store.PSO[propID]
 
@@ -378,6 +575,9 @@ func (store *HexastoreDB) QueryXPX(propID int) *[]Triple {
 // QueryXPO allows for querying the hexastore specifying only a Property ID
 // and an Object entity ID
 func (store *HexastoreDB) QueryXPO(propID, objID int) *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	res := []Triple{}
 	relevant := store.POS[propID]
 
@@ -401,6 +601,9 @@ func (store *HexastoreDB) QueryXPO(propID, objID int) *[]Triple {
 
 // QueryXXO allows for querying the hexastore specifying only an Object entity ID
 func (store *HexastoreDB) QueryXXO(objID int) *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	res := []Triple{}
 	relevant := store.OPS[objID]
 
@@ -420,6 +623,9 @@ func (store *HexastoreDB) QueryXXO(objID int) *[]Triple {
 
 // QuerySPO allows for querying the hexastore for a specific triple
 func (store *HexastoreDB) QuerySPO(subjID, propID, objID int) *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	if value, ok := store.SPO[subjID][propID][objID]; ok {
 		triple := MakeTriple(subjID, propID, objID, value)
 		return &[]Triple{*triple}
@@ -430,6 +636,9 @@ func (store *HexastoreDB) QuerySPO(subjID, propID, objID int) *[]Triple {
 
 // QueryXXX allows for a 'wildcard' query of the hexastore, returning all triples
 func (store *HexastoreDB) QueryXXX() *[]Triple {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
 	res := []Triple{}
 
 	for subjID, propMap := range store.SPO {
@@ -448,14 +657,15 @@ func (store *HexastoreDB) QueryXXX() *[]Triple {
  * End Query methods
  */
 
+// loadHexastore adds the entries of a plaintext representation to a store.
+// Their terms are in the form written by Term.String, as saved by dumpHexastore
 func loadHexastore(db tripleDb, store *HexastoreDB) error {
-	for _, entry := range db.Triples {
-		val := "xxxx" // TODO
-
-		store.Add(entry.Subject, entry.Prop, entry.Object, val)
+	ops := make([]txOp, len(db.Triples))
+	for i, entry := range db.Triples {
+		ops[i] = txOp{subject: entry.Subject, property: entry.Prop, object: entry.Object, value: entry.Value, graph: entry.Graph}
 	}
 
-	return nil
+	return store.applyBatch(ops)
 }
 
 // InitHexastoreFromJSON creates a new hexastore and fills it with triples
@@ -465,6 +675,11 @@ func loadHexastore(db tripleDb, store *HexastoreDB) error {
 //    ...
 //    ]
 // }
+// A triple's optional "value": <STRING> field, eg. an edge weight or a
+// timestamp, becomes its Triple.Value. A number or boolean value keeps the
+// text it's written with. A triple with a "graph": <STRING> field is added
+// to that named graph. Terms are in the form written by
+// Term.String, so strings in none of its term forms are plain literals
 func InitHexastoreFromJSON(dbFilePath string) (*HexastoreDB, error) {
 	var db tripleDb
 
@@ -473,7 +688,10 @@ func InitHexastoreFromJSON(dbFilePath string) (*HexastoreDB, error) {
 		return nil, err
 	}
 
-	json.Unmarshal(dat, &db)
+	err = json.Unmarshal(dat, &db)
+	if err != nil {
+		return nil, err
+	}
 
 	store := newHexastore()
 	err = loadHexastore(db, store)
@@ -490,14 +708,14 @@ func InitHexastoreFromJSON(dbFilePath string) (*HexastoreDB, error) {
 // {"subject": <STRING>, "prop": <STRING>, "object": <STRING>}
 // {"subject": <STRING>, "prop": <STRING>, "object": <STRING>}
 // {"subject": <STRING>, "prop": <STRING>, "object": <STRING>}
+//
+// A triple's optional "value": <STRING> field, eg. an edge weight or a
+// timestamp, becomes its Triple.Value. A number or boolean value keeps the
+// text it's written with. A triple with a "graph": <STRING> field is added
+// to that named graph
 func InitHexastoreFromJSONRows(dbFilePath string) (Hexastore, error) {
 	db := tripleDb{Triples: []Entry{}}
-	var entry Entry
 
-	// dat, err := ioutil.ReadFile(dbFilePath)
-	// if err != nil {
-	// 	return nil, err
-	// }
 	file, err := os.Open(dbFilePath)
 	if err != nil {
 		return nil, err
@@ -506,9 +724,20 @@ func InitHexastoreFromJSONRows(dbFilePath string) (Hexastore, error) {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		json.Unmarshal(scanner.Bytes(), &entry)
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, err
+		}
 		db.Triples = append(db.Triples, entry)
 	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
 
 	store := newHexastore()
 	err = loadHexastore(db, store)
@@ -519,8 +748,93 @@ func InitHexastoreFromJSONRows(dbFilePath string) (Hexastore, error) {
 	return store, nil
 }
 
+// dumpHexastore reads every triple of a store, including those in its named
+// graphs, out into its plaintext representation, sorted so that saved files
+// are deterministic
+func dumpHexastore(store Hexastore) tripleDb {
+	db := tripleDb{Triples: dumpGraph(store, "")}
+
+	if named, ok := store.(NamedGraphs); ok {
+		for _, name := range named.GraphNames() {
+			graph, _ := named.Graph(name)
+			db.Triples = append(db.Triples, dumpGraph(graph, name)...)
+		}
+	}
+
+	sort.Slice(db.Triples, func(i, j int) bool {
+		a, b := db.Triples[i], db.Triples[j]
+		if a.Graph != b.Graph {
+			return a.Graph < b.Graph
+		}
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		if a.Prop != b.Prop {
+			return a.Prop < b.Prop
+		}
+		return a.Object < b.Object
+	})
+
+	return db
+}
+
+func dumpGraph(store Hexastore, graph string) []Entry {
+	triples := store.QueryXXX()
+	entries := make([]Entry, len(*triples))
+
+	for i, t := range *triples {
+		entries[i] = Entry{
+			Subject: store.ResolveEntity(t.Subject),
+			Prop:    store.ResolveProp(t.Prop),
+			Object:  store.ResolveEntity(t.Object),
+			Value:   t.Value,
+			Graph:   graph,
+		}
+	}
+
+	return entries
+}
+
+// SaveToJSON writes every triple in a store to a file in the schema
+// read by InitHexastoreFromJSON
+func SaveToJSON(dbFilePath string, store Hexastore) error {
+	dat, err := json.MarshalIndent(dumpHexastore(store), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dbFilePath, dat, 0644)
+}
+
+// SaveToJSONRows writes every triple in a store to a file with one JSON
+// object (a triple) per line, the schema read by InitHexastoreFromJSONRows
+func SaveToJSONRows(dbFilePath string, store Hexastore) error {
+	file, err := os.Create(dbFilePath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range dumpHexastore(store).Triples {
+		if err = encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+const rdfType = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+
 // InitHexastoreFromTurtle creates a new hexastore and fills it with triples
 // from a file in Terse RDF Triple Language, or 'Turtle' (https://www.w3.org/TeamSubmission/turtle/)
+// IRIs, blank nodes and tagged or typed literals are kept as distinct terms
 func InitHexastoreFromTurtle(dbFilePath string) (Hexastore, error) {
 	db := tripleDb{}
 
@@ -534,9 +848,15 @@ func InitHexastoreFromTurtle(dbFilePath string) (Hexastore, error) {
 		return nil, err
 	}
 
+	prefixes := turtlePrefixes(dat)
 	db.Triples = make([]Entry, len(triples))
 	for i, t := range triples {
-		entry := Entry{Subject: t.Subj, Prop: t.Pred, Object: t.Obj}
+		prop := turtleTerm(t.Pred, prefixes)
+		if t.Pred == "a" {
+			prop = NewIRI(rdfType)
+		}
+
+		entry := Entry{Subject: turtleTerm(t.Subj, prefixes).String(), Prop: prop.String(), Object: turtleTerm(t.Obj, prefixes).String()}
 		db.Triples[i] = entry
 	}
 
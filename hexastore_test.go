@@ -1,6 +1,16 @@
 package simplegraphdb
 
-import "testing"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
 
 func TestMakeTriple(t *testing.T) {
 	triple := MakeTriple(1, 2, 3, "1234")
@@ -55,12 +65,10 @@ func TestPresentableResults(t *testing.T) {
 }
 
 func TestGetKey(t *testing.T) {
-	var dict Dictionary
+	dict := newDictionary()
 
-	dict.m = make(map[int]string)
-
-	dict.m[dict.NextKey] = "hello world"
-	dict.m[dict.NextKey+1] = "goodbye world"
+	dict.Put("hello world")
+	dict.Put("goodbye world")
 
 	helloWorldKey, ok := dict.GetKey("hello world")
 	if helloWorldKey != 0 {
@@ -78,6 +86,33 @@ func TestGetKey(t *testing.T) {
 	}
 }
 
+func TestGetKeyMissing(t *testing.T) {
+	dict := newDictionary()
+	dict.Put("hello world")
+
+	if _, ok := dict.GetKey("goodbye world"); ok {
+		t.Error("Expected success variable to be false for a missing value")
+	}
+}
+
+func TestPutExistingValue(t *testing.T) {
+	dict := newDictionary()
+
+	first := dict.Put("hello world")
+	dict.Put("goodbye world")
+	second := dict.Put("hello world")
+
+	if first != second {
+		t.Errorf("Expected existing ID %d for repeated value, got %d", first, second)
+	}
+	if dict.NextKey != 2 {
+		t.Error("Expected repeated value not to use up an ID. NextKey is ", dict.NextKey)
+	}
+	if val, _ := dict.Get(second); val != "hello world" {
+		t.Error("Expected 'hello world', got ", val)
+	}
+}
+
 func TestHexastoreAdd(t *testing.T) {
 	hexastore := newHexastore()
 	triple := Triple{Subject: 1, Prop: 2, Object: 3, Value: "hello world"}
@@ -135,6 +170,88 @@ func TestHexastoreRemove(t *testing.T) {
 	if _, ok := hexastore.PSO[2][1][3]; ok {
 		t.Error("Failed to remove triple from PSO")
 	}
+
+	if len(hexastore.SPO) != 0 || len(hexastore.SOP) != 0 || len(hexastore.PSO) != 0 ||
+		len(hexastore.POS) != 0 || len(hexastore.OSP) != 0 || len(hexastore.OPS) != 0 {
+		t.Error("Failed to prune empty index levels after removing the last triple")
+	}
+
+	if hexastore.remove(&triple) {
+		t.Error("Expected removing an absent triple to report false")
+	}
+}
+
+func TestHexastoreRemovePrunesOnlyEmptyLevels(t *testing.T) {
+	hexastore := newHexastore()
+	triple1 := Triple{Subject: 1, Prop: 2, Object: 3, Value: "hello world"}
+	triple2 := Triple{Subject: 1, Prop: 2, Object: 4, Value: "hello world"}
+
+	hexastore.add(&triple1)
+	hexastore.add(&triple2)
+	hexastore.remove(&triple1)
+
+	if _, ok := hexastore.SPO[1][2][4]; !ok {
+		t.Error("Removing one triple removed its sibling from SPO")
+	}
+	if _, ok := hexastore.OSP[3]; ok {
+		t.Error("Failed to prune OSP entry of removed object")
+	}
+	if _, ok := hexastore.POS[2][3]; ok {
+		t.Error("Failed to prune POS entry of removed object")
+	}
+
+	// re-adding after pruning must leave the mirrored indexes sharing maps again
+	hexastore.add(&triple1)
+	hexastore.remove(&triple2)
+
+	if len(*hexastore.QueryXPX(2)) != 1 || len(*hexastore.QueryXXO(3)) != 1 || len(*hexastore.QuerySXO(1, 3)) != 1 {
+		t.Error("Indexes disagree after re-adding a pruned triple")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	hexastore := newHexastore()
+	hexastore.Add("alice", "follows", "bob", "")
+	hexastore.Add("bob", "follows", "alice", "")
+
+	if !hexastore.Remove("alice", "follows", "bob") {
+		t.Error("Expected Remove of a stored triple to report true")
+	}
+	if hexastore.Remove("alice", "follows", "bob") {
+		t.Error("Expected second Remove of the same triple to report false")
+	}
+	if hexastore.Remove("alice", "likes", "carol") {
+		t.Error("Expected Remove of unknown values to report false")
+	}
+	if len(*hexastore.QueryXXX()) != 1 {
+		t.Error("Expected 1 triple left in store, got ", len(*hexastore.QueryXXX()))
+	}
+}
+
+func TestRemoveMatching(t *testing.T) {
+	hexastore := newHexastore()
+	hexastore.Add("alice", "follows", "bob", "")
+	hexastore.Add("alice", "follows", "carol", "")
+	hexastore.Add("alice", "likes", "bob", "")
+	hexastore.Add("bob", "follows", "alice", "")
+
+	removed := hexastore.RemoveMatching("alice", "follows", "?x")
+	if removed != 2 {
+		t.Error("Expected 2 triples removed, got ", removed)
+	}
+
+	removed = hexastore.RemoveMatching("?s", "?p", "carol")
+	if removed != 0 {
+		t.Error("Expected no triples left to remove, got ", removed)
+	}
+
+	removed = hexastore.RemoveMatching("?s", "?p", "?o")
+	if removed != 2 {
+		t.Error("Expected wildcard pattern to remove remaining 2 triples, got ", removed)
+	}
+	if len(hexastore.SPO) != 0 || len(hexastore.OPS) != 0 {
+		t.Error("Failed to prune indexes after removing every triple")
+	}
 }
 
 func TestQuerySXX(t *testing.T) {
@@ -175,6 +292,37 @@ func TestQuerySPX(t *testing.T) {
 	}
 }
 
+func TestQuerySXO(t *testing.T) {
+	hexastore := newHexastore()
+	triple1 := Triple{Subject: 1, Prop: 2, Object: 3, Value: "hello world"}
+	triple2 := Triple{Subject: 2, Prop: 2, Object: 3, Value: "hello world"}
+	triple3 := Triple{Subject: 1, Prop: 3, Object: 3, Value: "hello world"}
+	triple4 := Triple{Subject: 1, Prop: 4, Object: 2, Value: "hello world"}
+
+	hexastore.add(&triple1)
+	hexastore.add(&triple2)
+	hexastore.add(&triple3)
+	hexastore.add(&triple4)
+
+	results := hexastore.QuerySXO(1, 3)
+
+	if len(*results) != 2 {
+		t.Error("Subject+Object oriented query returned incorrect num of records. Expected 2, got ", len(*results))
+	}
+
+	for _, triple := range *results {
+		if !(triple.Prop == 2 || triple.Prop == 3) {
+			t.Error("Query returned incorrect triple. Expected Property ID to be 2 or 3, got ", triple.Prop)
+		}
+	}
+
+	results = hexastore.QuerySXO(2, 1)
+
+	if len(*results) != 0 {
+		t.Error("Subject+Object oriented query for unconnected entities should be empty, got ", len(*results))
+	}
+}
+
 func TestQueryXPO(t *testing.T) {
 	hexastore := newHexastore()
 	triple1 := Triple{Subject: 1, Prop: 2, Object: 3, Value: "hello world"}
@@ -261,3 +409,227 @@ func TestQuerySPO(t *testing.T) {
 		t.Error("Something went wrong")
 	}
 }
+
+// TestConcurrentReadersAndWriters is intended to be run with the race detector
+// (go test -race) to catch unguarded access to the indexes and dictionaries
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	hexastore := newHexastore()
+	hexastore.Add("alice", "follows", "bob", "")
+	var wg sync.WaitGroup
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				subject := fmt.Sprintf("user-%d-%d", w, i)
+				hexastore.Add(subject, "follows", "alice", "")
+				hexastore.Add("alice", "follows", subject, "")
+				if i%2 == 0 {
+					hexastore.Remove(subject, "follows", "alice")
+				}
+				if i%10 == 0 {
+					hexastore.RemoveMatching("alice", "follows", "?x")
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				aliceID, _ := hexastore.GetEntityKey("alice")
+				bobID, _ := hexastore.GetEntityKey("bob")
+				followsID, _ := hexastore.GetPropKey("follows")
+
+				hexastore.QueryXXX()
+				hexastore.QuerySXX(aliceID)
+				hexastore.QueryXPX(followsID)
+				hexastore.QueryXXO(aliceID)
+				hexastore.QuerySPX(aliceID, followsID)
+				hexastore.QuerySXO(aliceID, bobID)
+				hexastore.QueryXPO(followsID, aliceID)
+				hexastore.QuerySPO(aliceID, followsID, bobID)
+				for _, triple := range *hexastore.QueryXPO(followsID, aliceID) {
+					hexastore.ResolveEntity(triple.Subject)
+					hexastore.ResolveProp(triple.Prop)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	for w := 0; w < 4; w++ {
+		for i := 1; i < 200; i += 2 {
+			if !hexastore.Remove(fmt.Sprintf("user-%d-%d", w, i), "follows", "alice") {
+				t.Errorf("Expected concurrently added triple from user-%d-%d to be in the store", w, i)
+			}
+		}
+	}
+}
+
+func createRoundTripHexastore() *HexastoreDB {
+	hexastore := newHexastore()
+	hexastore.Add("alice", "follows", "bob", "since 2017")
+	hexastore.Add("bob", "follows", "alice", "")
+	hexastore.Add("alice", "says", "\"hi\"\nthere", "")
+	hexastore.Add("zoë", "follows", "alice", "")
+	hexastore.Add("bob", "likes", "bob", "")
+	hexastore.Remove("bob", "likes", "bob")
+
+	return hexastore
+}
+
+func TestSaveToJSONRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := createRoundTripHexastore()
+	dbFilePath := filepath.Join(dir, "db.json")
+
+	if err := SaveToJSON(dbFilePath, original); err != nil {
+		t.Fatal("Expected no error saving store, got ", err)
+	}
+	reloaded, err := InitHexastoreFromJSON(dbFilePath)
+	if err != nil {
+		t.Fatal("Expected no error reloading store, got ", err)
+	}
+
+	if diff := deep.Equal(dumpHexastore(original), dumpHexastore(reloaded)); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestSaveToJSONRowsRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := createRoundTripHexastore()
+	dbFilePath := filepath.Join(dir, "db.json")
+
+	if err := SaveToJSONRows(dbFilePath, original); err != nil {
+		t.Fatal("Expected no error saving store, got ", err)
+	}
+	reloaded, err := InitHexastoreFromJSONRows(dbFilePath)
+	if err != nil {
+		t.Fatal("Expected no error reloading store, got ", err)
+	}
+
+	expected := dumpHexastore(original)
+	if len(expected.Triples) != 4 {
+		t.Error("Expected 4 triples in the original store, got ", len(expected.Triples))
+	}
+	if diff := deep.Equal(expected, dumpHexastore(reloaded)); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestInitHexastoreFromJSONRowsMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbFilePath := filepath.Join(dir, "db.json")
+	rows := "{\"subject\": \"alice\", \"prop\": \"follows\", \"object\": \"bob\"}\n{\"subject\": \"bob\""
+	if err := ioutil.WriteFile(dbFilePath, []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InitHexastoreFromJSONRows(dbFilePath); err == nil {
+		t.Error("Expected error loading a truncated JSON rows file")
+	}
+}
+
+func TestInitHexastoreFromJSONRowsValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbFilePath := filepath.Join(dir, "db.json")
+	rows := "{\"subject\": \"alice\", \"prop\": \"follows\", \"object\": \"bob\", \"value\": \"0.5\"}\n" +
+		"{\"subject\": \"bob\", \"prop\": \"follows\", \"object\": \"alice\"}\n" +
+		"{\"subject\": \"carol\", \"prop\": \"follows\", \"object\": \"alice\", \"value\": 0.25}\n" +
+		"{\"subject\": \"dave\", \"prop\": \"follows\", \"object\": \"alice\", \"value\": true}\n"
+	if err := ioutil.WriteFile(dbFilePath, []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := InitHexastoreFromJSONRows(dbFilePath)
+	if err != nil {
+		t.Fatal("Expected no error loading store, got ", err)
+	}
+
+	expected := map[string]string{"alice": "0.5", "bob": "", "carol": "0.25", "dave": "true"}
+	for _, triple := range *store.QueryXXX() {
+		subject := store.ResolveEntity(triple.Subject)
+		if triple.Value != expected[subject] {
+			t.Errorf("Expected value '%s' for %s's triple, got '%s'", expected[subject], subject, triple.Value)
+		}
+	}
+
+	object := "{\"subject\": \"alice\", \"prop\": \"follows\", \"object\": \"bob\", \"value\": {\"weight\": 1}}\n"
+	if err := ioutil.WriteFile(dbFilePath, []byte(object), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitHexastoreFromJSONRows(dbFilePath); err == nil {
+		t.Error("Expected error loading a value which is a JSON object")
+	}
+}
+
+// syntheticEntries builds n triples over a graph where each of n/10 subjects
+// points at 10 objects, spread over a handful of properties
+func syntheticEntries(n int) []Entry {
+	entries := make([]Entry, n)
+	for i := range entries {
+		entries[i] = Entry{
+			Subject: fmt.Sprintf("entity-%d", i/10),
+			Prop:    fmt.Sprintf("prop-%d", i%7),
+			Object:  fmt.Sprintf("entity-%d", (i*31)%(n/10)),
+		}
+	}
+	return entries
+}
+
+func BenchmarkLoadMillionTriples(b *testing.B) {
+	db := tripleDb{Triples: syntheticEntries(1000000)}
+	b.ResetTimer()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		store := newHexastore()
+		loadHexastore(db, store)
+	}
+	logThroughput(b, len(db.Triples)*b.N, start)
+}
+
+func BenchmarkMapStringsToIds(b *testing.B) {
+	entries := syntheticEntries(1000000)
+	store := newHexastore()
+	b.ResetTimer()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		entry := entries[i%len(entries)]
+		store.MapStringsToIds(entry.Subject, entry.Prop, entry.Object)
+	}
+	logThroughput(b, b.N, start)
+}
+
+// logThroughput logs how many triples a benchmark handled per second since start
+func logThroughput(b *testing.B, triples int, start time.Time) {
+	b.Helper()
+	b.Logf("%.0f triples/s", float64(triples)/time.Since(start).Seconds())
+}
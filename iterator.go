@@ -0,0 +1,253 @@
+package simplegraphdb
+
+// TripleIterator walks the triples matching a query one at a time, so that
+// a caller can stop early without the store building every result up front:
+//
+//	it := store.IterXPX(propID)
+//	defer it.Close()
+//	for it.Next() {
+//		t := it.Triple()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Iterators don't hold the store's lock between calls to Next, so updates
+// made while iterating may or may not be seen
+type TripleIterator interface {
+	Next() bool
+	Triple() Triple
+	Err() error
+	Close() error
+}
+
+// collectTriples drains an iterator into a slice
+func collectTriples(it TripleIterator) (*[]Triple, error) {
+	defer it.Close()
+
+	res := []Triple{}
+	for it.Next() {
+		res = append(res, it.Triple())
+	}
+
+	return &res, it.Err()
+}
+
+// tripleSliceIterator walks triples which have already been found
+type tripleSliceIterator struct {
+	triples []Triple
+	pos     int
+}
+
+func newTripleSliceIterator(triples []Triple) *tripleSliceIterator {
+	return &tripleSliceIterator{triples: triples, pos: -1}
+}
+
+func (it *tripleSliceIterator) Next() bool {
+	if it.pos < len(it.triples) {
+		it.pos++
+	}
+	return it.pos < len(it.triples)
+}
+
+func (it *tripleSliceIterator) Triple() Triple { return it.triples[it.pos] }
+
+func (it *tripleSliceIterator) Err() error { return nil }
+
+func (it *tripleSliceIterator) Close() error {
+	it.pos = len(it.triples)
+	return nil
+}
+
+// The position of the subject, property and object in each level of an index
+var (
+	orderSPO = [3]int{0, 1, 2}
+	orderSOP = [3]int{0, 2, 1}
+	orderPSO = [3]int{1, 0, 2}
+	orderPOS = [3]int{1, 2, 0}
+	orderOPS = [3]int{2, 1, 0}
+)
+
+// indexIterator walks one of the store's indexes depth first. The keys of each
+// level are copied when the iterator reaches it, and the store's read lock is
+// only held during calls to Next, so triples removed before the iterator
+// reaches them are skipped
+type indexIterator struct {
+	store *HexastoreDB
+	index map[int]map[int]map[int]string
+	order [3]int
+	fixed []int // the IDs given for the leading levels of the index
+	// repeat is a level whose key must be the same as the level above's, or 0
+	repeat int
+
+	// pending holds the keys still to visit at each loaded level, with the
+	// first being the current key
+	pending [3][]int
+	loaded  int
+	done    bool
+	current Triple
+}
+
+func (store *HexastoreDB) iterIndex(index map[int]map[int]map[int]string, order [3]int, fixed ...int) TripleIterator {
+	return &indexIterator{store: store, index: index, order: order, fixed: fixed}
+}
+
+func (it *indexIterator) Next() bool {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+
+	for !it.done {
+		switch {
+		case it.loaded > 0 && len(it.pending[it.loaded-1]) == 0:
+			// this level is exhausted, so move on to the next key of the level above
+			it.loaded--
+			if it.loaded == 0 {
+				it.done = true
+			} else {
+				it.pending[it.loaded-1] = it.pending[it.loaded-1][1:]
+			}
+		case it.loaded < 3:
+			it.pending[it.loaded] = it.levelKeys(it.loaded)
+			it.loaded++
+		default:
+			a, b, c := it.pending[0][0], it.pending[1][0], it.pending[2][0]
+			it.pending[2] = it.pending[2][1:]
+
+			if value, ok := it.index[a][b][c]; ok {
+				var parts [3]int
+				parts[it.order[0]], parts[it.order[1]], parts[it.order[2]] = a, b, c
+				it.current = Triple{Subject: parts[0], Prop: parts[1], Object: parts[2], Value: value}
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// levelKeys copies the keys of a level of the index beneath the current keys
+// of the levels above it
+func (it *indexIterator) levelKeys(level int) []int {
+	key, single := 0, false
+	switch {
+	case level < len(it.fixed):
+		key, single = it.fixed[level], true
+	case it.repeat > 0 && level == it.repeat:
+		key, single = it.pending[level-1][0], true
+	}
+
+	if single {
+		var ok bool
+		switch level {
+		case 0:
+			_, ok = it.index[key]
+		case 1:
+			_, ok = it.index[it.pending[0][0]][key]
+		case 2:
+			_, ok = it.index[it.pending[0][0]][it.pending[1][0]][key]
+		}
+		if ok {
+			return []int{key}
+		}
+		return nil
+	}
+
+	var keys []int
+	switch level {
+	case 0:
+		for key := range it.index {
+			keys = append(keys, key)
+		}
+	case 1:
+		for key := range it.index[it.pending[0][0]] {
+			keys = append(keys, key)
+		}
+	case 2:
+		for key := range it.index[it.pending[0][0]][it.pending[1][0]] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (it *indexIterator) Triple() Triple { return it.current }
+
+func (it *indexIterator) Err() error { return nil }
+
+func (it *indexIterator) Close() error {
+	it.done = true
+	return nil
+}
+
+// reflexiveQuerier is implemented by stores which can find the triples whose
+// subject is also their object from their indexes, rather than by checking
+// every triple
+type reflexiveQuerier interface {
+	IterSXS() TripleIterator
+	IterSPS(propID int) TripleIterator
+}
+
+// reflexiveIterator skips the triples whose subject isn't also their object
+type reflexiveIterator struct {
+	TripleIterator
+}
+
+func (it *reflexiveIterator) Next() bool {
+	for it.TripleIterator.Next() {
+		if t := it.Triple(); t.Subject == t.Object {
+			return true
+		}
+	}
+	return false
+}
+
+// IterXXX iterates over every triple in the store
+func (store *HexastoreDB) IterXXX() TripleIterator {
+	return store.iterIndex(store.SPO, orderSPO)
+}
+
+// IterSXX iterates over the triples with a given subject
+func (store *HexastoreDB) IterSXX(subjID int) TripleIterator {
+	return store.iterIndex(store.SPO, orderSPO, subjID)
+}
+
+// IterXPX iterates over the triples with a given property
+func (store *HexastoreDB) IterXPX(propID int) TripleIterator {
+	return store.iterIndex(store.PSO, orderPSO, propID)
+}
+
+// IterXXO iterates over the triples with a given object
+func (store *HexastoreDB) IterXXO(objID int) TripleIterator {
+	return store.iterIndex(store.OPS, orderOPS, objID)
+}
+
+// IterSPX iterates over the triples with a given subject and property
+func (store *HexastoreDB) IterSPX(subjID, propID int) TripleIterator {
+	return store.iterIndex(store.SPO, orderSPO, subjID, propID)
+}
+
+// IterSXO iterates over the triples with a given subject and object
+func (store *HexastoreDB) IterSXO(subjID, objID int) TripleIterator {
+	return store.iterIndex(store.SOP, orderSOP, subjID, objID)
+}
+
+// IterXPO iterates over the triples with a given property and object
+func (store *HexastoreDB) IterXPO(propID, objID int) TripleIterator {
+	return store.iterIndex(store.POS, orderPOS, propID, objID)
+}
+
+// IterSPO iterates over the triple with a given subject, property and object, if it's in the store
+func (store *HexastoreDB) IterSPO(subjID, propID, objID int) TripleIterator {
+	return store.iterIndex(store.SPO, orderSPO, subjID, propID, objID)
+}
+
+// IterSXS iterates over the triples whose subject is also their object
+func (store *HexastoreDB) IterSXS() TripleIterator {
+	return &indexIterator{store: store, index: store.SOP, order: orderSOP, repeat: 1}
+}
+
+// IterSPS iterates over the triples with a given property whose subject is also their object
+func (store *HexastoreDB) IterSPS(propID int) TripleIterator {
+	return &indexIterator{store: store, index: store.PSO, order: orderPSO, fixed: []int{propID}, repeat: 2}
+}
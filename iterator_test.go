@@ -0,0 +1,213 @@
+package simplegraphdb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/thundergolfer/simplegraphdb/simplesparql"
+)
+
+func sortTriples(triples []Triple) []Triple {
+	sort.Slice(triples, func(i, j int) bool {
+		a, b := triples[i], triples[j]
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+		if a.Prop != b.Prop {
+			return a.Prop < b.Prop
+		}
+		return a.Object < b.Object
+	})
+	return triples
+}
+
+func TestIteratorsMatchQueries(t *testing.T) {
+	h := createTestHexastore()
+	apple, _ := h.GetEntityKey("Apple")
+	cow, _ := h.GetEntityKey("Cow")
+	likes, _ := h.GetPropKey("Likes")
+
+	cases := []struct {
+		name     string
+		iterator TripleIterator
+		expected *[]Triple
+	}{
+		{"XXX", h.IterXXX(), h.QueryXXX()},
+		{"SXX", h.IterSXX(apple), h.QuerySXX(apple)},
+		{"XPX", h.IterXPX(likes), h.QueryXPX(likes)},
+		{"XXO", h.IterXXO(cow), h.QueryXXO(cow)},
+		{"SPX", h.IterSPX(apple, likes), h.QuerySPX(apple, likes)},
+		{"SXO", h.IterSXO(apple, cow), h.QuerySXO(apple, cow)},
+		{"XPO", h.IterXPO(likes, apple), h.QueryXPO(likes, apple)},
+		{"SPO", h.IterSPO(apple, likes, cow), h.QuerySPO(apple, likes, cow)},
+		{"SPO missing", h.IterSPO(cow, likes, cow), h.QuerySPO(cow, likes, cow)},
+		{"SXX missing", h.IterSXX(1000), h.QuerySXX(1000)},
+	}
+
+	for _, c := range cases {
+		actual, err := collectTriples(c.iterator)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", c.name, err)
+		}
+		if diff := deep.Equal(sortTriples(*c.expected), sortTriples(*actual)); diff != nil {
+			t.Errorf("%s: %v", c.name, diff)
+		}
+	}
+}
+
+func TestReflexiveIterators(t *testing.T) {
+	h := createTestHexastore()
+	h.Add("Cow", "Dislikes", "Cow", "")
+	apple, _ := h.GetEntityKey("Apple")
+	cow, _ := h.GetEntityKey("Cow")
+	likes, _ := h.GetPropKey("Likes")
+	dislikes, _ := h.GetPropKey("Dislikes")
+
+	all, err := collectTriples(h.IterSXS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Triple{{apple, likes, apple, "jonob"}, {cow, dislikes, cow, ""}}
+	if diff := deep.Equal(sortTriples(expected), sortTriples(*all)); diff != nil {
+		t.Error(diff)
+	}
+
+	liked, err := collectTriples(h.IterSPS(likes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal([]Triple{{apple, likes, apple, "jonob"}}, *liked); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestIteratorSkipsRemovedTriples(t *testing.T) {
+	h := newHexastore()
+	for i := 0; i < 100; i++ {
+		h.Add("alice", "follows", fmt.Sprintf("user%d", i), "")
+	}
+
+	it := h.IterSXX(0)
+	defer it.Close()
+	if !it.Next() {
+		t.Fatal("Expected a first triple")
+	}
+
+	// the iterator holds no lock, so the store can be updated part way through
+	h.RemoveMatching("alice", "follows", "?x")
+	if it.Next() {
+		t.Errorf("Expected removed triples to be skipped, got %v", it.Triple())
+	}
+}
+
+func TestIteratorClose(t *testing.T) {
+	h := createTestHexastore()
+
+	it := h.IterXXX()
+	it.Next()
+	it.Close()
+	if it.Next() {
+		t.Error("Expected no triples after Close")
+	}
+}
+
+func TestDiskIteratorAcrossBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openTestDiskHexastore(t, dir, 100)
+	defer store.Close()
+	n := 3 * diskIteratorBatch
+	for i := 0; i < n; i++ {
+		store.Add("alice", "follows", fmt.Sprintf("user%d", i), "")
+	}
+
+	it := store.IterXPX(0)
+	count := 0
+	for it.Next() {
+		// updates between batches flush the memtable under the iterator
+		store.Add("bob", "likes", fmt.Sprintf("post%d", count), "")
+		count++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal("Expected no error iterating, got ", err)
+	}
+	if count != n {
+		t.Errorf("Expected %d triples, got %d", n, count)
+	}
+}
+
+// countingHexastore counts the triples pulled from its iterators
+type countingHexastore struct {
+	*HexastoreDB
+	pulled int
+}
+
+type countingIterator struct {
+	TripleIterator
+	store *countingHexastore
+}
+
+func (it countingIterator) Next() bool {
+	if it.TripleIterator.Next() {
+		it.store.pulled++
+		return true
+	}
+	return false
+}
+
+func (store *countingHexastore) IterXXX() TripleIterator {
+	return countingIterator{store.HexastoreDB.IterXXX(), store}
+}
+
+func (store *countingHexastore) IterSPX(subjID, propID int) TripleIterator {
+	return countingIterator{store.HexastoreDB.IterSPX(subjID, propID), store}
+}
+
+func TestGroupPatternEvaluatesLazily(t *testing.T) {
+	store := &countingHexastore{HexastoreDB: newHexastore()}
+	for i := 0; i < 1000; i++ {
+		store.Add(fmt.Sprintf("user%d", i), "follows", fmt.Sprintf("user%d", i+1), "")
+	}
+
+	queryModel, err := simplesparql.Parse("SELECT ?a, ?c WHERE { ?a ?p ?b . ?b 'follows' ?c }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	solutions := evaluateGroupPattern(context.Background(), queryModel.Where.Group, store)
+	defer solutions.close()
+
+	if !solutions.next() {
+		t.Fatal("Expected a solution")
+	}
+	// the last user follows nobody, so it may take one extra triple to find a join
+	if store.pulled > 3 {
+		t.Errorf("Expected the first solution to need at most 3 triples, pulled %d", store.pulled)
+	}
+}
+
+func TestLimitStopsScanningEarly(t *testing.T) {
+	store := &countingHexastore{HexastoreDB: newHexastore()}
+	for i := 0; i < 1000; i++ {
+		store.Add(fmt.Sprintf("user%d", i), "follows", fmt.Sprintf("user%d", i+1), "")
+	}
+
+	results, err := runQuery("SELECT ?a WHERE { ?a ?p ?b } LIMIT 5", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 6 {
+		t.Errorf("Expected 5 rows, got %d", len(results)-1)
+	}
+	if store.pulled > 5 {
+		t.Errorf("Expected LIMIT 5 to read at most 5 triples, read %d", store.pulled)
+	}
+}
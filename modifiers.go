@@ -0,0 +1,263 @@
+package simplegraphdb
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thundergolfer/simplegraphdb/simplesparql"
+)
+
+// applySolutionModifiers wraps the solutions of a query's WHERE clause with its
+// grouping, ORDER BY, DISTINCT, OFFSET and LIMIT modifiers, in that order
+func applySolutionModifiers(queryModel *(simplesparql.Select), returnVars []string, solutions solutionIterator) (solutionIterator, error) {
+	var limit int
+	offset, err := extractCount(queryModel.Offset, "OFFSET")
+	if err == nil {
+		limit, err = extractCount(queryModel.Limit, "LIMIT")
+	}
+	if err != nil {
+		solutions.close()
+		return nil, err
+	}
+
+	if isAggregateQuery(queryModel) {
+		solutions = &groupedSolutions{
+			input:       solutions,
+			groupBy:     queryModel.GroupBy,
+			projections: queryModel.Expression.Projections,
+			having:      queryModel.Having,
+		}
+	}
+	if len(queryModel.OrderBy) > 0 {
+		solutions = &orderedSolutions{input: solutions, keys: extractOrderKeys(queryModel.OrderBy)}
+	}
+	if queryModel.Distinct {
+		solutions = &distinctSolutions{input: solutions, vars: returnVars, seen: map[string]bool{}}
+	}
+	if offset > 0 || limit >= 0 {
+		solutions = &sliceSolutions{input: solutions, offset: offset, limit: limit}
+	}
+
+	return solutions, nil
+}
+
+// extractCount reads the integer given to a LIMIT or OFFSET modifier, or
+// -1 if the modifier wasn't given
+func extractCount(count *float64, modifier string) (int, error) {
+	if count == nil {
+		return -1, nil
+	}
+
+	n := *count
+	if n < 0 || n != math.Trunc(n) || n > math.MaxInt32 {
+		return 0, fmt.Errorf("%s must be given a non-negative integer", modifier)
+	}
+	return int(n), nil
+}
+
+// distinctSolutions drops solutions which bind the selected variables
+// to the same terms as an earlier solution
+type distinctSolutions struct {
+	input solutionIterator
+	vars  []string
+	seen  map[string]bool
+}
+
+func (it *distinctSolutions) next() bool {
+	for it.input.next() {
+		key := solutionKey(it.input.solution(), it.vars)
+		if !it.seen[key] {
+			it.seen[key] = true
+			return true
+		}
+	}
+	return false
+}
+
+func (it *distinctSolutions) solution() solution { return it.input.solution() }
+
+func (it *distinctSolutions) err() error { return it.input.err() }
+
+func (it *distinctSolutions) close() { it.input.close() }
+
+// solutionKey joins the terms a solution binds some variables to into a
+// string which is the same for every solution binding them alike
+func solutionKey(sol solution, vars []string) string {
+	key := make([]string, len(vars))
+	for i, v := range vars {
+		if val, ok := sol[v]; ok {
+			key[i] = "+" + val // distinguishes bound to "" from unbound
+		}
+	}
+	return strings.Join(key, "\x00")
+}
+
+// sliceSolutions skips the first offset solutions and then stops after limit
+// more, without pulling any further solutions from its input. A negative
+// limit means no limit
+type sliceSolutions struct {
+	input    solutionIterator
+	offset   int
+	limit    int
+	returned int
+}
+
+func (it *sliceSolutions) next() bool {
+	for ; it.offset > 0; it.offset-- {
+		if !it.input.next() {
+			return false
+		}
+	}
+
+	if it.limit >= 0 && it.returned >= it.limit {
+		return false
+	}
+	if !it.input.next() {
+		return false
+	}
+	it.returned++
+	return true
+}
+
+func (it *sliceSolutions) solution() solution { return it.input.solution() }
+
+func (it *sliceSolutions) err() error { return it.input.err() }
+
+func (it *sliceSolutions) close() { it.input.close() }
+
+type orderKey struct {
+	variable   string
+	descending bool
+}
+
+func extractOrderKeys(conditions []*simplesparql.OrderCondition) []orderKey {
+	keys := make([]orderKey, len(conditions))
+	for i, cond := range conditions {
+		if cond.Directed != nil {
+			keys[i] = orderKey{variable: cond.Directed.Var, descending: cond.Directed.Direction == "DESC"}
+		} else {
+			keys[i] = orderKey{variable: cond.Var}
+		}
+	}
+	return keys
+}
+
+// orderedSolutions sorts every solution of its input by a list of keys, each
+// of which only breaks ties left by those before it. Sorting is stable, so
+// solutions which tie on every key keep the order they were found in
+type orderedSolutions struct {
+	input     solutionIterator
+	keys      []orderKey
+	sorted    []solution
+	populated bool
+	current   solution
+}
+
+func (it *orderedSolutions) next() bool {
+	if !it.populated {
+		it.populated = true
+		for it.input.next() {
+			it.sorted = append(it.sorted, it.input.solution())
+		}
+		sort.SliceStable(it.sorted, func(i, j int) bool {
+			return compareSolutions(it.sorted[i], it.sorted[j], it.keys) < 0
+		})
+	}
+
+	if len(it.sorted) == 0 {
+		return false
+	}
+	it.current, it.sorted = it.sorted[0], it.sorted[1:]
+	return true
+}
+
+func (it *orderedSolutions) solution() solution { return it.current }
+
+func (it *orderedSolutions) err() error { return it.input.err() }
+
+func (it *orderedSolutions) close() {
+	it.sorted = nil
+	it.input.close()
+}
+
+func compareSolutions(a, b solution, keys []orderKey) int {
+	for _, key := range keys {
+		aVal, aOk := a[key.variable]
+		bVal, bOk := b[key.variable]
+
+		c := 0
+		switch {
+		case !aOk && !bOk:
+		case !aOk:
+			c = -1
+		case !bOk:
+			c = 1
+		default:
+			c = compareTerms(ParseTerm(aVal), ParseTerm(bVal))
+		}
+
+		if key.descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareTerms orders blank nodes, then IRIs, then literals. Numeric literals
+// come before other literals and are ordered by their value, and everything
+// else is ordered lexically
+func compareTerms(a, b Term) int {
+	if a.Kind != b.Kind {
+		return termKindRank(a.Kind) - termKindRank(b.Kind)
+	}
+
+	if a.Kind == LiteralTerm {
+		aNum, aIsNum := numericValue(a)
+		bNum, bIsNum := numericValue(b)
+		switch {
+		case aIsNum && bIsNum && aNum != bNum:
+			if aNum < bNum {
+				return -1
+			}
+			return 1
+		case aIsNum && !bIsNum:
+			return -1
+		case !aIsNum && bIsNum:
+			return 1
+		}
+	}
+
+	if c := strings.Compare(a.Value, b.Value); c != 0 {
+		return c
+	}
+	return strings.Compare(a.String(), b.String())
+}
+
+func termKindRank(kind TermKind) int {
+	switch kind {
+	case BlankTerm:
+		return 0
+	case IRITerm:
+		return 1
+	}
+	return 2
+}
+
+// numericValue reads the number held by a literal, which is numeric if it
+// isn't tagged with a language and its value parses as a number
+func numericValue(t Term) (float64, bool) {
+	if t.Kind != LiteralTerm || t.Lang != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(t.Value), 64)
+	if err != nil || math.IsNaN(n) {
+		return 0, false
+	}
+	return n, true
+}
@@ -1,166 +1,1060 @@
 package simplegraphdb
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/thundergolfer/simplegraphdb/simplesparql"
 )
 
+// ErrQueryTimeout is returned when a query's context reaches its deadline
+// before the query completes
+var ErrQueryTimeout = errors.New("query timed out")
+
+// ErrQueryCanceled is returned when a query's context is canceled before
+// the query completes
+var ErrQueryCanceled = errors.New("query canceled")
+
+// cancelCheckInterval is how many triples are scanned between checks of a
+// query's context
+const cancelCheckInterval = 64
+
 // RunQuery takes `simplesparql` valid string query and a Hexastore instance
 // and returns a formatted table of query results
 func RunQuery(query string, hexastore Hexastore) (string, error) {
-	resultsGrid, err := runQuery(query, hexastore)
+	return RunQueryContext(context.Background(), query, hexastore)
+}
+
+// RunQueryContext is RunQuery, but gives up with ErrQueryTimeout or
+// ErrQueryCanceled once ctx is done, checking it throughout the query's
+// index scans and joins
+func RunQueryContext(ctx context.Context, query string, hexastore Hexastore) (string, error) {
+	results, err := QueryContext(ctx, query, hexastore)
 	if err != nil {
 		return "", err
 	}
-	return PresentResultGrid(resultsGrid), nil
+	return PresentResultGrid(results.grid(unboundCell)), nil
 }
 
-func runQuery(query string, hexastore Hexastore) ([][]string, error) {
+// Query runs a `simplesparql` query against a Hexastore instance and returns
+// its results as terms rather than as a formatted table
+func Query(query string, hexastore Hexastore) (*ResultSet, error) {
+	return QueryContext(context.Background(), query, hexastore)
+}
+
+// QueryContext is Query, but gives up with ErrQueryTimeout or ErrQueryCanceled
+// once ctx is done
+func QueryContext(ctx context.Context, query string, hexastore Hexastore) (*ResultSet, error) {
+	if err := queryContextErr(ctx); err != nil {
+		return nil, err
+	}
+
 	queryModel, err := simplesparql.Parse(query)
 	if err != nil {
-		return [][]string{}, err
+		return nil, err
 	}
 
 	err = validateQuery(queryModel)
 	if err != nil {
-		return [][]string{}, err
+		return nil, err
 	}
 
 	returnVars := extractReturnVariables(queryModel)
-	rawResults := retreiveQueryResults(queryModel, hexastore)
-	mappedResults := mapTriplePartsToVars(hexastore, queryModel, rawResults)
-	resultsGrid := buildResultsGrid(returnVars, mappedResults, len(*rawResults))
+	solutions, err := applySolutionModifiers(queryModel, returnVars, evaluateGroupPattern(ctx, queryModel.Where.Group, hexastore))
+	if err != nil {
+		return nil, err
+	}
+	defer solutions.close()
+
+	return buildResultSet(returnVars, solutions)
+}
+
+// Ask runs a `simplesparql` ASK query against a Hexastore instance, returning
+// whether its pattern has any solutions. It stops at the first solution found
+func Ask(query string, hexastore Hexastore) (bool, error) {
+	return AskContext(context.Background(), query, hexastore)
+}
+
+// AskContext is Ask, but gives up with ErrQueryTimeout or ErrQueryCanceled
+// once ctx is done
+func AskContext(ctx context.Context, query string, hexastore Hexastore) (bool, error) {
+	if err := queryContextErr(ctx); err != nil {
+		return false, err
+	}
+
+	queryModel, err := simplesparql.ParseQuery(query)
+	if err != nil {
+		return false, err
+	}
+	if queryModel.Ask == nil {
+		return false, fmt.Errorf("Expected an ASK query")
+	}
+
+	if _, err = extractGroupVariables(queryModel.Ask.Group); err != nil {
+		return false, err
+	}
+
+	solutions := evaluateGroupPattern(ctx, queryModel.Ask.Group, hexastore)
+	defer solutions.close()
+
+	found := solutions.next()
+	return found, solutions.err()
+}
+
+func runQuery(query string, hexastore Hexastore) ([][]string, error) {
+	return runQueryContext(context.Background(), query, hexastore)
+}
+
+func runQueryContext(ctx context.Context, query string, hexastore Hexastore) ([][]string, error) {
+	results, err := QueryContext(ctx, query, hexastore)
+	if err != nil {
+		return [][]string{}, err
+	}
+	return results.Grid(), nil
+}
+
+// queryContextErr converts the error of a done context into the query's error
+func queryContextErr(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrQueryTimeout
+	default:
+		return ErrQueryCanceled
+	}
+}
+
+// cancellableIterator stops a scan of the store once the query's context is done
+type cancellableIterator struct {
+	TripleIterator
+	ctx     context.Context
+	scanned int
+	failure error
+}
+
+func (it *cancellableIterator) Next() bool {
+	if it.failure != nil {
+		return false
+	}
+	if it.scanned%cancelCheckInterval == 0 {
+		if it.failure = queryContextErr(it.ctx); it.failure != nil {
+			return false
+		}
+	}
+	it.scanned++
+
+	return it.TripleIterator.Next()
+}
+
+func (it *cancellableIterator) Err() error {
+	if it.failure != nil {
+		return it.failure
+	}
+	return it.TripleIterator.Err()
+}
+
+// solution maps the variables of a group pattern to the terms, in the form
+// written by Term.String, they were bound to by a single match of the pattern
+type solution map[string]string
+
+// solutionIterator lazily produces the solutions of a pattern, pulling
+// triples from the store only as each solution is asked for
+type solutionIterator interface {
+	next() bool
+	solution() solution
+	err() error
+	close()
+}
+
+// evaluateGroupPattern matches each element of the group in turn, substituting
+// the variables bound by earlier elements so that later elements act as a join.
+// FILTERs apply to the whole group, wherever they're written, so they're
+// applied once every other element has been matched
+func evaluateGroupPattern(ctx context.Context, group *simplesparql.GroupPattern, hexastore Hexastore) solutionIterator {
+	return joinGroupPattern(ctx, &solutionSlice{solutions: []solution{solution{}}}, group, hexastore)
+}
+
+func joinGroupPattern(ctx context.Context, solutions solutionIterator, group *simplesparql.GroupPattern, hexastore Hexastore) solutionIterator {
+	var filters []*simplesparql.Expression
+	for _, elem := range group.Elements {
+		switch {
+		case elem.Filter != nil:
+			filters = append(filters, elem.Filter)
+		case elem.Graph != nil:
+			solutions = joinGraphPattern(ctx, solutions, elem.Graph, hexastore)
+		case elem.Optional != nil:
+			solutions = &optionalJoin{ctx: ctx, input: solutions, group: elem.Optional, hexastore: hexastore}
+		case elem.Union != nil:
+			solutions = &unionJoin{ctx: ctx, input: solutions, branches: elem.Union.Groups, hexastore: hexastore}
+		case elem.Minus != nil:
+			solutions = joinMinusPattern(ctx, solutions, elem.Minus, hexastore)
+		default:
+			solutions = joinTriplePattern(ctx, solutions, elem.Triple, hexastore)
+		}
+	}
+
+	if len(filters) > 0 {
+		solutions = &filteredSolutions{input: solutions, filters: filters}
+	}
+	return solutions
+}
+
+// filteredSolutions drops the solutions for which any of the filters isn't
+// true, including those for which a filter has no value
+type filteredSolutions struct {
+	input   solutionIterator
+	filters []*simplesparql.Expression
+}
+
+func (it *filteredSolutions) next() bool {
+	for it.input.next() {
+		if it.keep(it.input.solution()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *filteredSolutions) keep(sol solution) bool {
+	for _, filter := range it.filters {
+		t, ok := evaluateExpression(filter, expressionScope{sol: sol})
+		if keep, boolOk := effectiveBooleanValue(t); !ok || !boolOk || !keep {
+			return false
+		}
+	}
+	return true
+}
+
+func (it *filteredSolutions) solution() solution { return it.input.solution() }
+
+func (it *filteredSolutions) err() error { return it.input.err() }
+
+func (it *filteredSolutions) close() { it.input.close() }
+
+// solutionSlice iterates over solutions which have already been found
+type solutionSlice struct {
+	solutions []solution
+	current   solution
+}
+
+func (it *solutionSlice) next() bool {
+	if len(it.solutions) == 0 {
+		return false
+	}
+	it.current, it.solutions = it.solutions[0], it.solutions[1:]
+	return true
+}
+
+func (it *solutionSlice) solution() solution { return it.current }
+
+func (it *solutionSlice) err() error { return nil }
+
+func (it *solutionSlice) close() { it.solutions = nil }
+
+// tripleJoin matches a triple pattern against each solution of its input,
+// including the value of each triple when the pattern has a VALUE term.
+// A constant value must equal the triple's value exactly
+type tripleJoin struct {
+	ctx                     context.Context
+	input                   solutionIterator
+	hexastore               Hexastore
+	first, second, third    string
+	value                   string
+	hasValue                bool
+	sol                     solution
+	boundFirst, boundSecond string
+	boundThird, boundValue  string
+	triples                 TripleIterator
+	current                 solution
+	failure                 error
+}
+
+func joinTriplePattern(ctx context.Context, solutions solutionIterator, pattern *simplesparql.TripleExpression, hexastore Hexastore) solutionIterator {
+	first, second, third := extractTripleExpressionElements(pattern)
+	value, hasValue := extractTripleValueElement(pattern)
+
+	return &tripleJoin{
+		ctx:       ctx,
+		input:     solutions,
+		hexastore: hexastore,
+		first:     first,
+		second:    second,
+		third:     third,
+		value:     value,
+		hasValue:  hasValue,
+	}
+}
+
+func (j *tripleJoin) next() bool {
+	for j.failure == nil {
+		if j.triples != nil && j.triples.Next() {
+			triple := j.triples.Triple()
+			value := NewLiteral(triple.Value).String()
+			if j.hasValue && !isSparqlVariable(j.boundValue) && value != j.boundValue {
+				continue
+			}
+
+			elems := []string{j.boundFirst, j.boundSecond, j.boundThird}
+			vals := []string{j.hexastore.ResolveEntity(triple.Subject), j.hexastore.ResolveProp(triple.Prop), j.hexastore.ResolveEntity(triple.Object)}
+			if j.hasValue {
+				elems, vals = append(elems, j.boundValue), append(vals, value)
+			}
+			extended, ok := j.sol.bind(elems, vals)
+			if !ok {
+				continue
+			}
+			j.current = extended
+			return true
+		}
+
+		if j.triples != nil {
+			j.failure = j.triples.Err()
+			j.triples.Close()
+			j.triples = nil
+			continue
+		}
+
+		if !j.input.next() {
+			j.failure = j.input.err()
+			return false
+		}
+		j.sol = j.input.solution()
+		j.boundFirst, j.boundSecond, j.boundThird = j.sol.substitute(j.first), j.sol.substitute(j.second), j.sol.substitute(j.third)
+		j.boundValue = j.sol.substitute(j.value)
+		j.triples = &cancellableIterator{
+			TripleIterator: retreiveTriples(j.boundFirst, j.boundSecond, j.boundThird, j.hexastore),
+			ctx:            j.ctx,
+		}
+	}
+
+	return false
+}
+
+func (j *tripleJoin) solution() solution { return j.current }
+
+func (j *tripleJoin) err() error { return j.failure }
+
+func (j *tripleJoin) close() {
+	if j.triples != nil {
+		j.triples.Close()
+		j.triples = nil
+	}
+	j.input.close()
+}
+
+// graphJoin matches a GRAPH block's group against the named graph it names,
+// or against every named graph in turn when the name is an unbound variable,
+// binding the variable to each graph's name. Stores without named graphs
+// never match a GRAPH block
+type graphJoin struct {
+	ctx       context.Context
+	input     solutionIterator
+	named     NamedGraphs
+	name      string
+	group     *simplesparql.GroupPattern
+	sol       solution
+	boundName string
+	pending   []string // the names of the graphs still to match for sol
+	inner     solutionIterator
+	failure   error
+}
+
+func joinGraphPattern(ctx context.Context, solutions solutionIterator, pattern *simplesparql.GraphPattern, hexastore Hexastore) solutionIterator {
+	named, ok := hexastore.(NamedGraphs)
+	if !ok {
+		solutions.close()
+		return &solutionSlice{}
+	}
+
+	return &graphJoin{ctx: ctx, input: solutions, named: named, name: tripleTermString(pattern.Name), group: pattern.Group}
+}
+
+func (j *graphJoin) next() bool {
+	for j.failure == nil {
+		if j.inner != nil && j.inner.next() {
+			return true
+		}
+
+		if j.inner != nil {
+			j.failure = j.inner.err()
+			j.inner.close()
+			j.inner = nil
+			continue
+		}
+
+		if len(j.pending) > 0 {
+			graphName := j.pending[0]
+			j.pending = j.pending[1:]
+			if graph, ok := j.named.Graph(graphName); ok {
+				start := &solutionSlice{solutions: []solution{j.sol.extend(j.boundName, graphName)}}
+				j.inner = joinGroupPattern(j.ctx, start, j.group, graph)
+			}
+			continue
+		}
+
+		if !j.input.next() {
+			j.failure = j.input.err()
+			return false
+		}
+		j.sol = j.input.solution()
+		j.boundName = j.sol.substitute(j.name)
+		j.pending = []string{j.boundName}
+		if isSparqlVariable(j.boundName) {
+			j.pending = j.named.GraphNames()
+		}
+	}
 
-	return resultsGrid, nil
+	return false
 }
 
-func buildResultsGrid(returnVars []string, mappedResults map[string][]string, numResults int) [][]string {
-	stringResults := make([][]string, numResults+1)
-	stringResults[0] = returnVars // add header
+func (j *graphJoin) solution() solution { return j.inner.solution() }
 
-	for i := 0; i < numResults; i++ {
-		stringResults[i+1] = make([]string, len(returnVars))
-		for j, rVar := range returnVars {
-			stringResults[i+1][j] = mappedResults[rVar][i]
+func (j *graphJoin) err() error { return j.failure }
+
+func (j *graphJoin) close() {
+	if j.inner != nil {
+		j.inner.close()
+		j.inner = nil
+	}
+	j.input.close()
+}
+
+// optionalJoin extends each solution of its input with the matches of an
+// OPTIONAL block's group, passing the solution through unchanged when the
+// group doesn't match so that its variables are left unbound
+type optionalJoin struct {
+	ctx       context.Context
+	input     solutionIterator
+	group     *simplesparql.GroupPattern
+	hexastore Hexastore
+	sol       solution
+	matched   bool
+	inner     solutionIterator
+	current   solution
+	failure   error
+}
+
+func (j *optionalJoin) next() bool {
+	for j.failure == nil {
+		if j.inner != nil {
+			if j.inner.next() {
+				j.matched = true
+				j.current = j.inner.solution()
+				return true
+			}
+
+			j.failure = j.inner.err()
+			j.inner.close()
+			j.inner = nil
+			if !j.matched && j.failure == nil {
+				j.current = j.sol
+				return true
+			}
+			continue
+		}
+
+		if !j.input.next() {
+			j.failure = j.input.err()
+			return false
+		}
+		j.sol = j.input.solution()
+		j.matched = false
+		j.inner = joinGroupPattern(j.ctx, &solutionSlice{solutions: []solution{j.sol}}, j.group, j.hexastore)
+	}
+
+	return false
+}
+
+func (j *optionalJoin) solution() solution { return j.current }
+
+func (j *optionalJoin) err() error { return j.failure }
+
+func (j *optionalJoin) close() {
+	if j.inner != nil {
+		j.inner.close()
+		j.inner = nil
+	}
+	j.input.close()
+}
+
+// unionJoin matches each branch of a UNION against each solution of its input
+// in turn, yielding the matches of every branch. A variable bound by only
+// some of the branches is left unbound in the matches of the others
+type unionJoin struct {
+	ctx       context.Context
+	input     solutionIterator
+	branches  []*simplesparql.GroupPattern
+	hexastore Hexastore
+	sol       solution
+	pending   []*simplesparql.GroupPattern // the branches still to match for sol
+	inner     solutionIterator
+	failure   error
+}
+
+func (j *unionJoin) next() bool {
+	for j.failure == nil {
+		if j.inner != nil && j.inner.next() {
+			return true
+		}
+
+		if j.inner != nil {
+			j.failure = j.inner.err()
+			j.inner.close()
+			j.inner = nil
+			continue
+		}
+
+		if len(j.pending) > 0 {
+			branch := j.pending[0]
+			j.pending = j.pending[1:]
+			j.inner = joinGroupPattern(j.ctx, &solutionSlice{solutions: []solution{j.sol}}, branch, j.hexastore)
+			continue
 		}
+
+		if !j.input.next() {
+			j.failure = j.input.err()
+			return false
+		}
+		j.sol = j.input.solution()
+		j.pending = j.branches
+	}
+
+	return false
+}
+
+func (j *unionJoin) solution() solution { return j.inner.solution() }
+
+func (j *unionJoin) err() error { return j.failure }
+
+func (j *unionJoin) close() {
+	if j.inner != nil {
+		j.inner.close()
+		j.inner = nil
 	}
+	j.input.close()
+}
 
-	return stringResults
+// minusJoin drops each solution of its input which is compatible with a match
+// of a MINUS block's group, sharing at least one variable with it. The group is
+// matched against each solution with the variables its leading triple patterns
+// share with it substituted, as every match binds those. A solution sharing
+// only variables the group may leave unbound is checked against the group's
+// matches on their own, which are found once, when first needed
+type minusJoin struct {
+	ctx       context.Context
+	input     solutionIterator
+	group     *simplesparql.GroupPattern
+	hexastore Hexastore
+	vars      []string // the variables a match of the group can bind
+	required  []string // the variables every match binds before any nested block
+	excluded  []solution
+	populated bool
+	failure   error
 }
 
-func retreiveQueryResults(queryModel *simplesparql.Select, hexastore Hexastore) *[]Triple {
-	first, second, third := extractTripleExpressionElements(queryModel)
+func joinMinusPattern(ctx context.Context, solutions solutionIterator, group *simplesparql.GroupPattern, hexastore Hexastore) solutionIterator {
+	vars, _ := extractGroupVariables(group)
+
+	var required []string
+	for _, elem := range group.Elements {
+		if elem.Filter != nil {
+			continue
+		}
+		if elem.Triple == nil {
+			break
+		}
+		first, second, third := extractTripleExpressionElements(elem.Triple)
+		value, _ := extractTripleValueElement(elem.Triple)
+		required = append(required, getVariablesFromStrings(first, second, third, value)...)
+	}
+
+	return &minusJoin{ctx: ctx, input: solutions, group: group, hexastore: hexastore, vars: vars, required: required}
+}
+
+func (j *minusJoin) next() bool {
+	for j.failure == nil && j.input.next() {
+		excluded, err := j.excludes(j.input.solution())
+		if err != nil {
+			j.failure = err
+			return false
+		}
+		if !excluded {
+			return true
+		}
+	}
+	if j.failure == nil {
+		j.failure = j.input.err()
+	}
+	return false
+}
+
+func (j *minusJoin) excludes(sol solution) (bool, error) {
+	shared := false
+	for _, v := range j.vars {
+		if _, ok := sol[v]; ok {
+			shared = true
+			break
+		}
+	}
+	if !shared {
+		return false, nil
+	}
+
+	seed := solution{}
+	for _, v := range j.required {
+		if val, ok := sol[v]; ok {
+			seed[v] = val
+		}
+	}
+	if len(seed) == 0 {
+		return j.excludedOnItsOwn(sol)
+	}
+
+	matches := joinGroupPattern(j.ctx, &solutionSlice{solutions: []solution{seed}}, j.group, j.hexastore)
+	defer matches.close()
+	for matches.next() {
+		if compatibleMinus(sol, matches.solution()) {
+			return true, nil
+		}
+	}
+	return false, matches.err()
+}
+
+// excludedOnItsOwn checks a solution against the matches of the group found
+// without substituting any of its variables
+func (j *minusJoin) excludedOnItsOwn(sol solution) (bool, error) {
+	if !j.populated {
+		j.populated = true
+		matches := evaluateGroupPattern(j.ctx, j.group, j.hexastore)
+		for matches.next() {
+			j.excluded = append(j.excluded, matches.solution())
+		}
+		err := matches.err()
+		matches.close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, excluded := range j.excluded {
+		if compatibleMinus(sol, excluded) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compatibleMinus gives whether a match of a MINUS block's group removes a
+// solution, sharing at least one variable with it and agreeing on them all
+func compatibleMinus(sol, match solution) bool {
+	shared := false
+	for v, val := range match {
+		if bound, ok := sol[v]; ok {
+			if bound != val {
+				return false
+			}
+			shared = true
+		}
+	}
+	return shared
+}
+
+func (j *minusJoin) solution() solution { return j.input.solution() }
+
+func (j *minusJoin) err() error { return j.failure }
+
+func (j *minusJoin) close() {
+	j.excluded = nil
+	j.input.close()
+}
+
+// substitute returns the value bound to elem if it's a variable of the solution,
+// otherwise elem is returned unchanged
+func (sol solution) substitute(elem string) string {
+	if val, ok := sol[elem]; ok {
+		return val
+	}
+	return elem
+}
+
+// extend returns a copy of the solution with variable bound to val. Non-variable
+// elements leave the solution unchanged
+func (sol solution) extend(elem, val string) solution {
+	if !isSparqlVariable(elem) {
+		return sol
+	}
+
+	extended := make(solution, len(sol)+1)
+	for k, v := range sol {
+		extended[k] = v
+	}
+	extended[elem] = val
+	return extended
+}
+
+// bind returns a copy of the solution with each variable of elems bound to the
+// matching value. A variable repeated in elems must be matched by the same
+// value each time, otherwise bind fails
+func (sol solution) bind(elems, vals []string) (solution, bool) {
+	extended := make(solution, len(sol)+len(elems))
+	for k, v := range sol {
+		extended[k] = v
+	}
+
+	for i, elem := range elems {
+		if !isSparqlVariable(elem) {
+			continue
+		}
+		if bound, ok := extended[elem]; ok && bound != vals[i] {
+			return nil, false
+		}
+		extended[elem] = vals[i]
+	}
+	return extended, true
+}
+
+// retreiveQueryResults finds every triple matching a pattern in which
+// simplesparql variables act as wildcards, and a repeated variable only
+// matches triples with the same term in each of its positions
+func retreiveQueryResults(first, second, third string, hexastore Hexastore) *[]Triple {
+	res, _ := collectTriples(retreiveTriples(first, second, third, hexastore))
+	if !isSparqlVariable(second) || (second != first && second != third) {
+		return res
+	}
+
+	// retreiveTriples only narrows on a repeated subject and object, so a
+	// repeated property is checked the way triple patterns in queries are
+	elems := []string{first, second, third}
+	matches := (*res)[:0]
+	for _, t := range *res {
+		vals := []string{hexastore.ResolveEntity(t.Subject), hexastore.ResolveProp(t.Prop), hexastore.ResolveEntity(t.Object)}
+		if _, ok := (solution{}).bind(elems, vals); ok {
+			matches = append(matches, t)
+		}
+	}
+	return &matches
+}
+
+// retreiveTriples iterates over the triples matching a pattern, picking the
+// access pattern from which of its elements are variables
+func retreiveTriples(first, second, third string, hexastore Hexastore) TripleIterator {
+	if isSparqlVariable(first) && first == third {
+		return retreiveReflexiveTriples(second, hexastore)
+	}
 
 	if isSparqlVariable(first) { // X??
 		if isSparqlVariable(second) { // XX?
 			if isSparqlVariable(third) { // XXX
-				return hexastore.QueryXXX()
+				return hexastore.IterXXX()
+			}
+			objID, ok := hexastore.GetEntityKey(third)
+			if !ok {
+				return newTripleSliceIterator(nil)
 			}
-			objID, _ := hexastore.GetEntityKey(third)
-			return hexastore.QueryXXO(objID) // XXO
+			return hexastore.IterXXO(objID) // XXO
 		} else if isSparqlVariable(third) { // XPX
-			propID, _ := hexastore.GetPropKey(second)
-			return hexastore.QueryXPX(propID)
+			propID, ok := hexastore.GetPropKey(second)
+			if !ok {
+				return newTripleSliceIterator(nil)
+			}
+			return hexastore.IterXPX(propID)
 		} // XPO
 
-		propID, _ := hexastore.GetPropKey(second)
-		objID, _ := hexastore.GetEntityKey(third)
-		return hexastore.QueryXPO(propID, objID)
-	} else if isSparqlVariable(second) { // SX?
-		subjID, _ := hexastore.GetEntityKey(first)
+		propID, propOk := hexastore.GetPropKey(second)
+		objID, objOk := hexastore.GetEntityKey(third)
+		if !propOk || !objOk {
+			return newTripleSliceIterator(nil)
+		}
+		return hexastore.IterXPO(propID, objID)
+	}
+
+	subjID, ok := hexastore.GetEntityKey(first)
+	if !ok {
+		return newTripleSliceIterator(nil)
+	}
+
+	if isSparqlVariable(second) { // SX?
 		if isSparqlVariable(third) { // SXX
-			return hexastore.QuerySXX(subjID)
+			return hexastore.IterSXX(subjID)
 		} // SXO
-		objID, _ := hexastore.GetEntityKey(third)
-		return hexastore.QuerySXO(subjID, objID)
-	} else if isSparqlVariable(third) { // SPX
-		subjID, _ := hexastore.GetEntityKey(first)
-		propID, _ := hexastore.GetPropKey(second)
-		return hexastore.QuerySPX(subjID, propID)
-	} // SPO
-
-	subjID, _ := hexastore.GetEntityKey(first)
-	propID, _ := hexastore.GetPropKey(second)
-	objID, _ := hexastore.GetEntityKey(third)
-	return hexastore.QuerySPO(subjID, propID, objID)
-}
+		objID, ok := hexastore.GetEntityKey(third)
+		if !ok {
+			return newTripleSliceIterator(nil)
+		}
+		return hexastore.IterSXO(subjID, objID)
+	}
 
-func mapTriplePartsToVars(store Hexastore, queryModel *simplesparql.Select, results *[]Triple) (mappedParts map[string][]string) {
-	var firstVarName, scndVarName, thirdVarName string
-	numResults := len(*results)
-	mappedParts = make(map[string][]string)
-	first, second, third := extractTripleExpressionElements(queryModel)
+	propID, ok := hexastore.GetPropKey(second)
+	if !ok {
+		return newTripleSliceIterator(nil)
+	}
 
-	if isSparqlVariable(first) {
-		firstVarName = first
-		mappedParts[firstVarName] = make([]string, numResults)
+	if isSparqlVariable(third) { // SPX
+		return hexastore.IterSPX(subjID, propID)
+	} // SPO
 
+	objID, ok := hexastore.GetEntityKey(third)
+	if !ok {
+		return newTripleSliceIterator(nil)
 	}
-	if isSparqlVariable(second) {
-		scndVarName = second
-		mappedParts[scndVarName] = make([]string, numResults)
-	}
-	if isSparqlVariable(third) {
-		thirdVarName = third
-		mappedParts[thirdVarName] = make([]string, numResults)
-	}
+	return hexastore.IterSPO(subjID, propID, objID)
+}
 
-	for i, triple := range *results {
-		if firstVarName != "" {
-			mappedParts[firstVarName][i] = store.ResolveEntity(triple.Subject)
+// retreiveReflexiveTriples iterates over the triples whose subject is also their
+// object, matching patterns such as ?x 'follows' ?x
+func retreiveReflexiveTriples(second string, hexastore Hexastore) TripleIterator {
+	var propID int
+	if !isSparqlVariable(second) {
+		var ok bool
+		if propID, ok = hexastore.GetPropKey(second); !ok {
+			return newTripleSliceIterator(nil)
 		}
-		if scndVarName != "" {
-			mappedParts[scndVarName][i] = store.ResolveProp(triple.Prop)
-		}
-		if thirdVarName != "" {
-			mappedParts[thirdVarName][i] = store.ResolveEntity(triple.Object)
+	}
+
+	if reflexive, ok := hexastore.(reflexiveQuerier); ok {
+		if isSparqlVariable(second) {
+			return reflexive.IterSXS()
 		}
+		return reflexive.IterSPS(propID)
 	}
 
-	return
+	if isSparqlVariable(second) {
+		return &reflexiveIterator{hexastore.IterXXX()}
+	}
+	return &reflexiveIterator{hexastore.IterXPX(propID)}
 }
 
 func validateQuery(queryModel *(simplesparql.Select)) error {
 	var ok bool
 
 	returnVars := extractReturnVariables(queryModel)
-	first, second, third := extractTripleExpressionElements(queryModel)
-	tripleExprElems := []string{first, second, third}
 
 	ok = validateNoDuplicateVariables(returnVars)
 	if !ok {
 		return fmt.Errorf("Duplicate variable name in SELECT variables")
 	}
 
-	ok = validateNoDuplicateVariables(tripleExprElems)
-	if !ok {
-		return fmt.Errorf("Duplicate variable name in WHERE expression variables")
+	whereVars, err := extractGroupVariables(queryModel.Where.Group)
+	if err != nil {
+		return err
 	}
 
-	whereVars := getVariablesFromStrings(tripleExprElems...)
-
-	ok = validateVariablesBalance(returnVars, whereVars)
+	ok = validateVariablesBalance(extractSelectedVariables(queryModel), whereVars)
 	if !ok {
 		return fmt.Errorf("Cant fulfil SELECT expression with variables from WHERE expression")
 	}
 
+	if isAggregateQuery(queryModel) {
+		return validateAggregates(queryModel, whereVars)
+	}
+
+	if !validateVariablesBalance(extractOrderVariables(queryModel), whereVars) {
+		return fmt.Errorf("Cant ORDER BY variables missing from WHERE expression")
+	}
+
+	return nil
+}
+
+// validateAggregates checks that a grouped query only selects the variables
+// it groups by, and aggregates over variables bound by its WHERE clause
+func validateAggregates(queryModel *(simplesparql.Select), whereVars []string) error {
+	if queryModel.Expression.All {
+		return fmt.Errorf("Cant SELECT * in a query with GROUP BY, HAVING or aggregates")
+	}
+
+	if !validateVariablesBalance(queryModel.GroupBy, whereVars) {
+		return fmt.Errorf("Cant GROUP BY variables missing from WHERE expression")
+	}
+
+	if !validateVariablesBalance(extractSelectedVariables(queryModel), queryModel.GroupBy) {
+		return fmt.Errorf("Variables in SELECT expression must be in GROUP BY or aggregated")
+	}
+
+	if queryModel.Having != nil {
+		if err := validateHaving(queryModel, whereVars); err != nil {
+			return err
+		}
+	}
+
+	for _, projection := range queryModel.Expression.Projections {
+		if projection.Aggregate == nil {
+			continue
+		}
+
+		agg := projection.Aggregate.Aggregate
+		if agg.All && agg.Function != "COUNT" {
+			return fmt.Errorf("Only COUNT can aggregate over *")
+		}
+		if !agg.All && !validateVariablesBalance([]string{agg.Var}, whereVars) {
+			return fmt.Errorf("Cant aggregate over %s, which is missing from WHERE expression", agg.Var)
+		}
+		if validateVariablesBalance([]string{projection.Aggregate.As}, whereVars) {
+			return fmt.Errorf("Cant bind aggregate to %s, which is already in WHERE expression", projection.Aggregate.As)
+		}
+	}
+
+	if !validateVariablesBalance(extractOrderVariables(queryModel), extractGroupedVariables(queryModel)) {
+		return fmt.Errorf("Variables in ORDER BY must be in GROUP BY or aggregated")
+	}
+
+	return nil
+}
+
+// validateHaving checks that a HAVING condition only uses the variables bound
+// in each group, and aggregates over variables bound by the WHERE clause
+func validateHaving(queryModel *(simplesparql.Select), whereVars []string) error {
+	if err := validateExpression(queryModel.Having, true); err != nil {
+		return err
+	}
+
+	var havingVars, aggregatedVars []string
+	walkExpressionTerms(queryModel.Having, func(term *simplesparql.TripleTerm) {
+		switch {
+		case term.Var != "":
+			havingVars = append(havingVars, term.Var)
+		case term.Aggregate != nil && !term.Aggregate.All:
+			aggregatedVars = append(aggregatedVars, term.Aggregate.Var)
+		}
+	})
+
+	if !validateVariablesBalance(havingVars, extractGroupedVariables(queryModel)) {
+		return fmt.Errorf("Variables in HAVING must be in GROUP BY or aggregated")
+	}
+	if !validateVariablesBalance(aggregatedVars, whereVars) {
+		return fmt.Errorf("Cant aggregate over variables missing from WHERE expression in HAVING")
+	}
 	return nil
 }
 
+// extractGroupVariables lists the variables of every pattern in a group,
+// including those nested in GRAPH, OPTIONAL and UNION blocks. FILTERs and
+// MINUS blocks don't bind variables, so they're only checked
+func extractGroupVariables(group *simplesparql.GroupPattern) ([]string, error) {
+	groupVars := []string{}
+
+	for _, elem := range group.Elements {
+		if elem.Filter != nil {
+			if err := validateExpression(elem.Filter, false); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if elem.Minus != nil {
+			if _, err := extractGroupVariables(elem.Minus); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var nested []*simplesparql.GroupPattern
+		switch {
+		case elem.Optional != nil:
+			nested = []*simplesparql.GroupPattern{elem.Optional}
+		case elem.Union != nil:
+			nested = elem.Union.Groups
+		}
+		for _, nestedGroup := range nested {
+			nestedVars, err := extractGroupVariables(nestedGroup)
+			if err != nil {
+				return nil, err
+			}
+			groupVars = append(groupVars, nestedVars...)
+		}
+		if len(nested) > 0 {
+			continue
+		}
+
+		if elem.Graph != nil {
+			if err := validateTripleTerm(elem.Graph.Name); err != nil {
+				return nil, err
+			}
+			groupVars = append(groupVars, getVariablesFromStrings(tripleTermString(elem.Graph.Name))...)
+
+			nestedVars, err := extractGroupVariables(elem.Graph.Group)
+			if err != nil {
+				return nil, err
+			}
+			groupVars = append(groupVars, nestedVars...)
+			continue
+		}
+
+		for _, term := range []*simplesparql.TripleTerm{elem.Triple.First, elem.Triple.Second, elem.Triple.Third, elem.Triple.Value} {
+			if term == nil {
+				continue
+			}
+			if err := validateTripleTerm(term); err != nil {
+				return nil, err
+			}
+		}
+
+		first, second, third := extractTripleExpressionElements(elem.Triple)
+		value, _ := extractTripleValueElement(elem.Triple)
+		groupVars = append(groupVars, getVariablesFromStrings(first, second, third, value)...)
+	}
+
+	return groupVars, nil
+}
+
+// extractReturnVariables lists the variables of a query's results, which are
+// its selected variables and the variables its aggregates are bound to. SELECT *
+// selects every variable the WHERE clause can bind, in the order they appear
 func extractReturnVariables(queryModel *(simplesparql.Select)) (returnVars []string) {
-	selectExpressions := queryModel.Expression.Expressions
+	if queryModel.Expression.All {
+		whereVars, _ := extractGroupVariables(queryModel.Where.Group)
+		seen := map[string]bool{}
+		for _, v := range whereVars {
+			if !seen[v] {
+				seen[v] = true
+				returnVars = append(returnVars, v)
+			}
+		}
+		return
+	}
 
-	for _, expr := range selectExpressions {
-		variable := getVariableFromExpression(expr)
-		returnVars = append(returnVars, variable)
+	for _, projection := range queryModel.Expression.Projections {
+		if projection.Aggregate != nil {
+			returnVars = append(returnVars, projection.Aggregate.As)
+		} else {
+			returnVars = append(returnVars, projection.Var)
+		}
 	}
 	return
 }
 
-func getVariableFromExpression(expr *(simplesparql.Expression)) string {
-	return expr.And.Or[0].Operand.Operand.Summand[0].LHS.LHS.Var
+// extractSelectedVariables lists the variables a query selects from its
+// WHERE clause, leaving out those its aggregates are bound to
+func extractSelectedVariables(queryModel *(simplesparql.Select)) (selectedVars []string) {
+	for _, projection := range queryModel.Expression.Projections {
+		if projection.Aggregate == nil {
+			selectedVars = append(selectedVars, projection.Var)
+		}
+	}
+	return
+}
+
+// extractOrderVariables lists the variables a query's ORDER BY sorts on
+func extractOrderVariables(queryModel *(simplesparql.Select)) (orderVars []string) {
+	for _, key := range extractOrderKeys(queryModel.OrderBy) {
+		orderVars = append(orderVars, key.variable)
+	}
+	return
+}
+
+// extractGroupedVariables lists the variables bound in each solution of a
+// grouped query, which are those it groups by and the aggregates it selects
+func extractGroupedVariables(queryModel *(simplesparql.Select)) []string {
+	groupedVars := append([]string{}, queryModel.GroupBy...)
+	for _, projection := range queryModel.Expression.Projections {
+		if projection.Aggregate != nil {
+			groupedVars = append(groupedVars, projection.Aggregate.As)
+		}
+	}
+	return groupedVars
 }
 
 func isSparqlVariable(val string) bool {
@@ -204,25 +1098,73 @@ func validateVariablesBalance(selectExprVars, whereExprVars []string) bool {
 	return true
 }
 
-func extractTripleExpressionElements(queryModel *(simplesparql.Select)) (first, second, third string) {
-	where := queryModel.Where
+func extractTripleExpressionElements(expr *(simplesparql.TripleExpression)) (first, second, third string) {
+	return tripleTermString(expr.First), tripleTermString(expr.Second), tripleTermString(expr.Third)
+}
 
-	if where.Expression.First.Value != nil {
-		first = *where.Expression.First.Value.String
-	} else {
-		first = where.Expression.First.Var
+// extractTripleValueElement gives the VALUE term of a triple pattern, which is
+// matched against triples' values. Values are plain literals, so constants are
+// compared by their raw string rather than as tagged or typed terms
+func extractTripleValueElement(expr *(simplesparql.TripleExpression)) (string, bool) {
+	switch {
+	case expr.Value == nil:
+		return "", false
+	case expr.Value.Value != nil:
+		value, _ := literalValue(expr.Value.Value)
+		return NewLiteral(value).String(), true
 	}
+	return tripleTermString(expr.Value), true
+}
 
-	if where.Expression.Second.Value != nil {
-		second = *where.Expression.Second.Value.String
-	} else {
-		second = where.Expression.Second.Var
+// tripleTermString gives a variable's name, or the form a constant term
+// takes in the store's string based methods
+func tripleTermString(term *(simplesparql.TripleTerm)) string {
+	if term.IRI != "" {
+		return ParseTerm(term.IRI).String()
+	}
+	if term.Value == nil {
+		return term.Var
 	}
 
-	if where.Expression.Third.Value != nil {
-		third = *where.Expression.Third.Value.String
-	} else {
-		third = where.Expression.Third.Var
+	value, _ := literalValue(term.Value)
+	switch {
+	case term.Lang != "":
+		return NewLangLiteral(value, term.Lang[1:]).String()
+	case term.Datatype != "":
+		return NewTypedLiteral(value, ParseTerm(term.Datatype).Value).String()
 	}
-	return
+	return NewLiteral(value).String()
+}
+
+// literalValue gives the string a constant in a pattern stands for. Numbers
+// and booleans stand for the strings they're written as, eg. 30 and true.
+// Other values, such as NULL, can't be matched against the store
+func literalValue(value *simplesparql.Value) (string, bool) {
+	switch {
+	case value.String != nil:
+		return *value.String, true
+	case value.Number != nil:
+		n := *value.Number
+		if value.Negated {
+			n = -n
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), true
+	case value.Boolean != nil:
+		return strconv.FormatBool(bool(*value.Boolean)), true
+	}
+	return "", false
+}
+
+// validateTripleTerm checks that a term of a pattern is a variable or a
+// constant which can be matched against the store
+func validateTripleTerm(term *(simplesparql.TripleTerm)) error {
+	switch {
+	case term.Var != "" || term.IRI != "":
+		return nil
+	case term.Value != nil:
+		if _, ok := literalValue(term.Value); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unsupported term in WHERE expression, expected a variable, IRI, string, number or boolean")
 }
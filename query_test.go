@@ -1,8 +1,11 @@
 package simplegraphdb
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
 )
@@ -84,6 +87,71 @@ func Test_runQueryOnValidQueries(t *testing.T) {
 				[]string{"Apple", "Cow"},
 			},
 		},
+		{
+			comment: "subject and object given",
+			query:   "SELECT ?p WHERE { 'Cow' ?p 'Banana' }",
+			expected: [][]string{
+				[]string{"?p"},
+				[]string{"Dislikes"},
+			},
+		},
+		{
+			comment: "subject and object given with no connecting property",
+			query:   "SELECT ?p WHERE { 'Banana' ?p 'Apple' }",
+			expected: [][]string{
+				[]string{"?p"},
+			},
+		},
+		{
+			comment: "join on shared variables",
+			query:   "SELECT ?a, ?b WHERE { ?a 'Likes' ?b . ?b 'Likes' ?a }",
+			expected: [][]string{
+				[]string{"?a", "?b"},
+				[]string{"Apple", "Cow"},
+				[]string{"Cow", "Apple"},
+				[]string{"Apple", "Apple"},
+			},
+		},
+		{
+			comment: "chained join with trailing separator",
+			query:   "SELECT ?x, ?y WHERE { ?x 'Likes' ?y . ?y 'Dislikes' 'Banana' . }",
+			expected: [][]string{
+				[]string{"?x", "?y"},
+				[]string{"Apple", "Cow"},
+			},
+		},
+		{
+			comment: "triple values bound to a variable",
+			query:   "SELECT ?y, ?v WHERE { 'Cow' ?p ?y VALUE ?v }",
+			expected: [][]string{
+				[]string{"?y", "?v"},
+				[]string{"Banana", "jonob"},
+				[]string{"Apple", "jonob"},
+			},
+		},
+		{
+			comment: "triple values matched against a constant",
+			query:   "SELECT ?x WHERE { ?x 'Dislikes' ?y VALUE 'jonob' }",
+			expected: [][]string{
+				[]string{"?x"},
+				[]string{"Cow"},
+				[]string{"Banana"},
+			},
+		},
+		{
+			comment: "triple values not matching a constant",
+			query:   "SELECT ?x WHERE { ?x 'Dislikes' ?y VALUE 'someone else' . ?y 'Likes' 'Apple' }",
+			expected: [][]string{
+				[]string{"?x"},
+			},
+		},
+		{
+			comment: "join with no matches",
+			query:   "SELECT ?x WHERE { ?x 'Dislikes' ?y . ?y 'Dislikes' 'Apple' }",
+			expected: [][]string{
+				[]string{"?x"},
+			},
+		},
 	}
 
 	for _, c := range cases {
@@ -102,6 +170,25 @@ func Test_runQueryOnValidQueries(t *testing.T) {
 	}
 }
 
+func Test_runQueryWithConstantValues(t *testing.T) {
+	hexastore := newHexastore()
+	hexastore.Add("alice", "rates", "bob", "-1")
+	hexastore.Add("alice", "rates", "carol", "true")
+	hexastore.Add("alice", "rates", "dave", "0.5")
+
+	cases := map[string]string{
+		"SELECT ?p WHERE { 'alice' 'rates' ?p VALUE -1 }":   "bob",
+		"SELECT ?p WHERE { 'alice' 'rates' ?p VALUE TRUE }": "carol",
+		"SELECT ?p WHERE { 'alice' 'rates' ?p VALUE 0.5 }":  "dave",
+	}
+	for query, expected := range cases {
+		actual, err := runQuery(query, hexastore)
+		if err != nil || len(actual) != 2 || actual[1][0] != expected {
+			t.Errorf("%s: expected %s, got %v, %v", query, expected, actual, err)
+		}
+	}
+}
+
 func Test_runQueryWithWellFormedButInvalidQueries(t *testing.T) {
 	hexastore := createTestHexastore()
 	cases := []struct {
@@ -113,11 +200,11 @@ func Test_runQueryWithWellFormedButInvalidQueries(t *testing.T) {
 			expected: fmt.Errorf("Duplicate variable name in SELECT variables"),
 		},
 		{
-			query:    "SELECT ?x, ?y WHERE { ?x ?x ?y }",
-			expected: fmt.Errorf("Duplicate variable name in WHERE expression variables"),
+			query:    "SELECT ?y, ?x WHERE { ?x 'Likes' 'Stuff' }",
+			expected: fmt.Errorf("Cant fulfil SELECT expression with variables from WHERE expression"),
 		},
 		{
-			query:    "SELECT ?y, ?x WHERE { ?x 'Likes' 'Stuff' }",
+			query:    "SELECT ?x, ?z WHERE { ?x 'Likes' ?y . ?y ?y 'Cow' }",
 			expected: fmt.Errorf("Cant fulfil SELECT expression with variables from WHERE expression"),
 		},
 	}
@@ -140,3 +227,698 @@ func Test_runQueryWithMalformedQueries(t *testing.T) {
 		t.Errorf("FAIL: expected error from malformed simplesparql query but got no error")
 	}
 }
+
+func Test_runQueryConcurrentlyWithWrites(t *testing.T) {
+	hexastore := createTestHexastore()
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			hexastore.Add(fmt.Sprintf("Pear-%d", i), "Likes", "Banana", "jonob")
+			hexastore.Remove("Cow", "Likes", "Apple")
+			hexastore.Add("Cow", "Likes", "Apple", "jonob")
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_, err := RunQuery("SELECT ?x, ?y WHERE { ?x 'Likes' ?y . ?y 'Likes' ?x }", hexastore)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestRunQueryContextCanceled(t *testing.T) {
+	hexastore := createTestHexastore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := RunQueryContext(ctx, "SELECT ?x WHERE { ?x 'Likes' 'Banana' }", hexastore); err != ErrQueryCanceled {
+		t.Errorf("Expected '%v', got '%v'", ErrQueryCanceled, err)
+	}
+}
+
+func TestRunQueryContextTimeout(t *testing.T) {
+	hexastore := newHexastore()
+	for i := 0; i < 200; i++ {
+		hexastore.Add(fmt.Sprintf("user%d", i), "follows", fmt.Sprintf("user%d", (i+1)%200), "")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// a cross product of every triple with every other, far too slow to finish
+	query := "SELECT ?a, ?b, ?c, ?d, ?e, ?f WHERE { ?a ?p ?b . ?c ?q ?d . ?e ?r ?f }"
+	start := time.Now()
+	if _, err := RunQueryContext(ctx, query, hexastore); err != ErrQueryTimeout {
+		t.Errorf("Expected '%v', got '%v'", ErrQueryTimeout, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the query to stop soon after its deadline, took %v", elapsed)
+	}
+}
+
+func Test_runQueryWithSolutionModifiers(t *testing.T) {
+	hexastore := createTestHexastore()
+	cases := []struct {
+		comment  string
+		query    string
+		expected int // number of rows, excluding the header
+	}{
+		{"no modifiers", "SELECT ?x WHERE { ?x 'Likes' ?y }", 4},
+		{"distinct", "SELECT DISTINCT ?x WHERE { ?x 'Likes' ?y }", 2},
+		{"distinct over every selected variable", "SELECT DISTINCT ?x, ?y WHERE { ?x 'Likes' ?y }", 4},
+		{"limit", "SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT 3", 3},
+		{"limit zero", "SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT 0", 0},
+		{"limit beyond results", "SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT 100", 4},
+		{"offset", "SELECT ?x WHERE { ?x 'Likes' ?y } OFFSET 1", 3},
+		{"offset beyond results", "SELECT ?x WHERE { ?x 'Likes' ?y } OFFSET 10", 0},
+		{"limit and offset", "SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT 2 OFFSET 3", 1},
+		{"distinct with limit", "SELECT DISTINCT ?x WHERE { ?x 'Likes' ?y } LIMIT 5", 2},
+		{"distinct with offset", "SELECT DISTINCT ?x WHERE { ?x 'Likes' ?y } OFFSET 1", 1},
+		{"distinct with offset beyond results", "SELECT DISTINCT ?x WHERE { ?x 'Likes' ?y } LIMIT 1 OFFSET 2", 0},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if len(actual)-1 != c.expected {
+			t.Errorf("Error in test '%s': expected %d rows of data, got %d", c.comment, c.expected, len(actual)-1)
+		}
+	}
+
+	distinct, _ := runQuery("SELECT DISTINCT ?x WHERE { ?x 'Likes' ?y }", hexastore)
+	expected := [][]string{{"?x"}, {"Apple"}, {"Cow"}}
+	if !checkResultsEquality(expected, distinct) {
+		t.Errorf("Expected %v, got %v", expected, distinct)
+	}
+}
+
+func Test_runQueryWithInvalidSolutionModifiers(t *testing.T) {
+	hexastore := createTestHexastore()
+	queries := []string{
+		"SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT -1",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT 1.5",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } OFFSET 'ten'",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT NOT 1",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT !1",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT 1 + 2",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT 5 > 1",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } OFFSET (1)",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } LIMIT - 1",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } ORDER BY ?z",
+		"SELECT ?x WHERE { ?x 'Likes' ?y } ORDER BY ?x DESC(?z)",
+	}
+
+	for _, query := range queries {
+		if _, err := runQuery(query, hexastore); err == nil {
+			t.Errorf("Expected an error from '%s'", query)
+		}
+	}
+}
+
+func Test_runQueryWithOrderBy(t *testing.T) {
+	h := newHexastore()
+	h.Add("alice", "age", "9", "")
+	h.Add("bob", "age", "10", "")
+	h.Add("carol", "age", "10", "")
+	h.Add("dave", "age", "unknown", "")
+	h.Add("erin", "age", "2.5", "")
+
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			"numeric order",
+			"SELECT ?age, ?p WHERE { ?p 'age' ?age } ORDER BY ?age ?p",
+			[][]string{{"?age", "?p"}, {"2.5", "erin"}, {"9", "alice"}, {"10", "bob"}, {"10", "carol"}, {"unknown", "dave"}},
+		},
+		{
+			"descending with a second key",
+			"SELECT ?age, ?p WHERE { ?p 'age' ?age } ORDER BY DESC(?age) ASC(?p)",
+			[][]string{{"?age", "?p"}, {"unknown", "dave"}, {"10", "bob"}, {"10", "carol"}, {"9", "alice"}, {"2.5", "erin"}},
+		},
+		{
+			"lexical order",
+			"SELECT ?p WHERE { ?p 'age' ?age } ORDER BY desc(?p)",
+			[][]string{{"?p"}, {"erin"}, {"dave"}, {"carol"}, {"bob"}, {"alice"}},
+		},
+		{
+			"ordered before limit and offset",
+			"SELECT ?p WHERE { ?p 'age' ?age } ORDER BY ?age ?p LIMIT 2 OFFSET 1",
+			[][]string{{"?p"}, {"alice"}, {"bob"}},
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, h)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if diff := deep.Equal(c.expected, actual); diff != nil {
+			t.Errorf("Error in test '%s': %v", c.comment, diff)
+		}
+	}
+}
+
+func TestCompareTerms(t *testing.T) {
+	ordered := []Term{
+		NewBlankNode("b0"),
+		NewIRI("http://example.org/a"),
+		NewLiteral("-3"),
+		NewTypedLiteral("1e2", "http://www.w3.org/2001/XMLSchema#double"),
+		NewLangLiteral("10", "en"),
+		NewLiteral("Apple"),
+		NewLiteral("apple"),
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			c := compareTerms(ordered[i], ordered[j])
+			if (i < j && c >= 0) || (i > j && c <= 0) || (i == j && c != 0) {
+				t.Errorf("Expected %v and %v to compare as %d, got %d", ordered[i], ordered[j], j-i, c)
+			}
+		}
+	}
+}
+
+func createFollowersHexastore() *HexastoreDB {
+	h := newHexastore()
+
+	h.Add("alice", "follows", "bob", "")
+	h.Add("carol", "follows", "bob", "")
+	h.Add("dave", "follows", "bob", "")
+	h.Add("bob", "follows", "alice", "")
+	h.Add("carol", "follows", "alice", "")
+	h.Add("alice", "follows", "carol", "")
+	h.Add("alice", "age", "30", "")
+	h.Add("bob", "age", "25", "")
+	h.Add("carol", "age", "41", "")
+
+	return h
+}
+
+func Test_runQueryWithAggregates(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			"count per group",
+			"SELECT ?user (COUNT(?f) AS ?followers) WHERE { ?f 'follows' ?user } GROUP BY ?user ORDER BY DESC(?followers)",
+			[][]string{{"?user", "?followers"}, {"bob", "3"}, {"alice", "2"}, {"carol", "1"}},
+		},
+		{
+			"having on an aggregate",
+			"SELECT ?user, (COUNT(?f) AS ?followers) WHERE { ?f 'follows' ?user } GROUP BY ?user HAVING (COUNT(?f) >= 2) ORDER BY ?user",
+			[][]string{{"?user", "?followers"}, {"alice", "2"}, {"bob", "3"}},
+		},
+		{
+			"having on a bound aggregate",
+			"SELECT ?user (COUNT(?f) AS ?followers) WHERE { ?f 'follows' ?user } GROUP BY ?user HAVING (?followers > 2)",
+			[][]string{{"?user", "?followers"}, {"bob", "3"}},
+		},
+		{
+			"count without grouping",
+			"SELECT (COUNT(*) AS ?n) (COUNT(DISTINCT ?user) AS ?users) WHERE { ?f 'follows' ?user }",
+			[][]string{{"?n", "?users"}, {"6", "3"}},
+		},
+		{
+			"count of no solutions",
+			"SELECT (COUNT(?f) AS ?n) WHERE { ?f 'follows' 'nobody' }",
+			[][]string{{"?n"}, {"0"}},
+		},
+		{
+			"no groups",
+			"SELECT ?user (COUNT(?f) AS ?n) WHERE { ?f 'follows' 'nobody' . ?f 'follows' ?user } GROUP BY ?user",
+			[][]string{{"?user", "?n"}},
+		},
+		{
+			"sum, min, max and avg",
+			"SELECT (SUM(?age) AS ?sum) (MIN(?age) AS ?min) (MAX(?age) AS ?max) (AVG(?age) AS ?avg) WHERE { ?p 'age' ?age }",
+			[][]string{{"?sum", "?min", "?max", "?avg"}, {"96", "25", "41", "32"}},
+		},
+		{
+			"sum of non-numbers",
+			"SELECT (SUM(?f) AS ?sum) WHERE { ?f 'follows' ?user }",
+			[][]string{{"?sum"}, {""}},
+		},
+		{
+			"aggregate over a join",
+			"SELECT ?user (AVG(?age) AS ?followerAge) WHERE { ?f 'follows' ?user . ?f 'age' ?age } GROUP BY ?user ORDER BY ?user",
+			[][]string{{"?user", "?followerAge"}, {"alice", "33"}, {"bob", "35.5"}, {"carol", "30"}},
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if diff := deep.Equal(c.expected, actual); diff != nil {
+			t.Errorf("Error in test '%s': %v", c.comment, diff)
+		}
+	}
+}
+
+func Test_runQueryWithInvalidAggregates(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	queries := []string{
+		"SELECT ?user ?f WHERE { ?f 'follows' ?user } GROUP BY ?user",
+		"SELECT ?user (COUNT(?f) AS ?n) WHERE { ?f 'follows' ?user }",
+		"SELECT (COUNT(?x) AS ?n) WHERE { ?f 'follows' ?user }",
+		"SELECT (SUM(*) AS ?n) WHERE { ?f 'follows' ?user }",
+		"SELECT (COUNT(?f) AS ?user) WHERE { ?f 'follows' ?user }",
+		"SELECT ?x WHERE { ?f 'follows' ?user } GROUP BY ?x",
+		"SELECT (COUNT(?f) ?n) WHERE { ?f 'follows' ?user }",
+		"SELECT ?user (COUNT(?f) AS ?n) WHERE { ?f 'follows' ?user } GROUP BY ?user ORDER BY ?f",
+		"SELECT ?user WHERE { ?f 'follows' ?user } GROUP BY ?user HAVING (?f != 'alice')",
+		"SELECT ?user WHERE { ?f 'follows' ?user } GROUP BY ?user HAVING (?x > 1)",
+		"SELECT ?user WHERE { ?f 'follows' ?user } GROUP BY ?user HAVING (COUNT(?x) > 1)",
+		"SELECT ?user WHERE { ?f 'follows' ?user } GROUP BY ?user HAVING (STRSTARTS(?f, 'a'))",
+	}
+
+	for _, query := range queries {
+		if _, err := runQuery(query, hexastore); err == nil {
+			t.Errorf("Expected an error from '%s'", query)
+		}
+	}
+}
+
+func Test_runQueryWithFilters(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	hexastore.AddTerms(NewLiteral("alice"), NewLiteral("name"), NewLangLiteral("Alice", "en"), "")
+	hexastore.AddTerms(NewLiteral("bob"), NewLiteral("name"), NewLangLiteral("Robert", "fr"), "")
+	hexastore.AddTerms(NewLiteral("carol"), NewLiteral("name"), NewLiteral("carol"), "")
+
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			"numeric comparison",
+			"SELECT ?p WHERE { ?p 'age' ?age FILTER(?age > 29) } ORDER BY ?p",
+			[][]string{{"?p"}, {"alice"}, {"carol"}},
+		},
+		{
+			"filter before the pattern binding its variable",
+			"SELECT ?p WHERE { FILTER(?age < 30) ?p 'age' ?age }",
+			[][]string{{"?p"}, {"bob"}},
+		},
+		{
+			"boolean logic",
+			"SELECT ?p WHERE { ?p 'age' ?age FILTER(?age < 26 || ?age > 40 && !(?p = 'alice')) } ORDER BY ?p",
+			[][]string{{"?p"}, {"bob"}, {"carol"}},
+		},
+		{
+			"inequality between variables",
+			"SELECT ?a, ?b WHERE { ?a 'follows' ?b . ?b 'follows' ?a FILTER(?a != ?b && ?a < ?b) } ORDER BY ?b",
+			[][]string{{"?a", "?b"}, {"alice", "bob"}, {"alice", "carol"}},
+		},
+		{
+			"several filters",
+			"SELECT ?p WHERE { ?p 'age' ?age . FILTER(?age >= 25) . FILTER(?age <= 30) } ORDER BY ?p",
+			[][]string{{"?p"}, {"alice"}, {"bob"}},
+		},
+		{
+			"regex",
+			"SELECT ?p WHERE { ?p 'name' ?name FILTER REGEX(?name, '^r', 'i') }",
+			[][]string{{"?p"}, {"bob"}},
+		},
+		{
+			"contains and strstarts",
+			"SELECT ?p WHERE { ?p 'name' ?name FILTER(CONTAINS(?name, 'ar') || STRSTARTS(?name, 'Al')) } ORDER BY ?p",
+			[][]string{{"?p"}, {"alice"}, {"carol"}},
+		},
+		{
+			"lang",
+			"SELECT ?name WHERE { ?p 'name' ?name FILTER(LANG(?name) = 'fr') }",
+			[][]string{{"?name"}, {`"Robert"@fr`}},
+		},
+		{
+			"type errors are false",
+			"SELECT ?p WHERE { ?p 'name' ?name FILTER(?name > 3 || ?unbound) }",
+			[][]string{{"?p"}},
+		},
+		{
+			"filter in a graph block",
+			"SELECT ?p WHERE { GRAPH 'g' { ?p 'age' ?age FILTER(?age = 30) } }",
+			[][]string{{"?p"}},
+		},
+		{
+			"negated parenthesised expression",
+			"SELECT ?p WHERE { ?p 'age' ?age FILTER(-(?age) < -29) } ORDER BY ?p",
+			[][]string{{"?p"}, {"alice"}, {"carol"}},
+		},
+		{
+			"negated string has no value",
+			"SELECT ?p WHERE { ?p 'age' ?age FILTER(-'abc' < 0 || -(?p) < 0) }",
+			[][]string{{"?p"}},
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if diff := deep.Equal(c.expected, actual); diff != nil {
+			t.Errorf("Error in test '%s': %v", c.comment, diff)
+		}
+	}
+}
+
+func Test_runQueryWithInvalidFilters(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	queries := []string{
+		"SELECT ?p WHERE { ?p 'age' ?age FILTER(CONTAINS(?p)) }",
+		"SELECT ?p WHERE { ?p 'age' ?age FILTER(REGEX(?p, 'a', 'i', 'x')) }",
+		"SELECT ?p WHERE { ?p 'age' ?age FILTER(COUNT(?age) > 1) }",
+		"SELECT ?p WHERE { ?p 'age' ?age FILTER(?age, ?p) }",
+		"SELECT ?p WHERE { ?p 'age' ?age FILTER(?age > ) }",
+	}
+
+	for _, query := range queries {
+		if _, err := runQuery(query, hexastore); err == nil {
+			t.Errorf("Expected an error from '%s'", query)
+		}
+	}
+}
+
+func Test_runQueryWithOptional(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	hexastore.Add("alice", "location", "Melbourne", "")
+	hexastore.Add("bob", "location", "Sydney", "")
+	hexastore.Add("bob", "location", "Perth", "")
+
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			"optional location",
+			"SELECT ?p, ?loc WHERE { ?p 'age' ?age OPTIONAL { ?p 'location' ?loc } } ORDER BY ?p ?loc",
+			[][]string{{"?p", "?loc"}, {"alice", "Melbourne"}, {"bob", "Perth"}, {"bob", "Sydney"}, {"carol", ""}},
+		},
+		{
+			"filter inside an optional",
+			"SELECT ?p, ?loc WHERE { ?p 'age' ?age . OPTIONAL { ?p 'location' ?loc FILTER(?loc != 'Perth') } } ORDER BY ?p",
+			[][]string{{"?p", "?loc"}, {"alice", "Melbourne"}, {"bob", "Sydney"}, {"carol", ""}},
+		},
+		{
+			"optional group of several patterns",
+			"SELECT ?p, ?f WHERE { ?p 'age' ?age OPTIONAL { ?f 'follows' ?p . ?f 'location' 'Perth' } } ORDER BY ?p",
+			[][]string{{"?p", "?f"}, {"alice", "bob"}, {"bob", ""}, {"carol", ""}},
+		},
+		{
+			"unbound variables aren't counted",
+			"SELECT (COUNT(?loc) AS ?n) (COUNT(*) AS ?rows) WHERE { ?p 'age' ?age OPTIONAL { ?p 'location' ?loc } }",
+			[][]string{{"?n", "?rows"}, {"3", "4"}},
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if diff := deep.Equal(c.expected, actual); diff != nil {
+			t.Errorf("Error in test '%s': %v", c.comment, diff)
+		}
+	}
+
+	results, err := Query("SELECT ?loc WHERE { 'carol' 'age' ?age OPTIONAL { 'carol' 'location' ?loc } }", hexastore)
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+	if len(results.Rows) != 1 || results.Rows[0][0].Bound {
+		t.Errorf("Expected a single unbound row, got %v", results.Rows)
+	}
+}
+
+func Test_runQueryWithUnionAndMinus(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			"people who follow alice or carol",
+			"SELECT DISTINCT ?p WHERE { { ?p 'follows' 'alice' } UNION { ?p 'follows' 'carol' } } ORDER BY ?p",
+			[][]string{{"?p"}, {"alice"}, {"bob"}, {"carol"}},
+		},
+		{
+			"variables bound by one branch",
+			"SELECT ?p, ?age WHERE { { ?p 'follows' 'carol' } UNION { ?p 'age' ?age FILTER(?age > 40) } } ORDER BY ?p",
+			[][]string{{"?p", "?age"}, {"alice", ""}, {"carol", "41"}},
+		},
+		{
+			"union joined with a later pattern",
+			"SELECT ?p, ?age WHERE { { ?p 'follows' 'alice' } UNION { ?p 'follows' 'carol' } . ?p 'age' ?age } ORDER BY ?p ?age",
+			[][]string{{"?p", "?age"}, {"alice", "30"}, {"bob", "25"}, {"carol", "41"}},
+		},
+		{
+			"people alice follows who don't follow back",
+			"SELECT ?p WHERE { 'alice' 'follows' ?p MINUS { ?p 'follows' 'alice' } }",
+			[][]string{{"?p"}},
+		},
+		{
+			"people followed who don't follow back",
+			"SELECT ?a, ?b WHERE { { ?a 'follows' ?b } MINUS { ?b 'follows' ?a } } ORDER BY ?a ?b",
+			[][]string{{"?a", "?b"}, {"carol", "bob"}, {"dave", "bob"}},
+		},
+		{
+			"minus sharing no variables",
+			"SELECT ?p WHERE { ?p 'age' ?age MINUS { ?x 'follows' ?y } } ORDER BY ?p",
+			[][]string{{"?p"}, {"alice"}, {"bob"}, {"carol"}},
+		},
+		{
+			"minus filtering a shared variable",
+			"SELECT ?p WHERE { ?p 'age' ?age MINUS { ?p 'age' ?a FILTER(?a > 28) } }",
+			[][]string{{"?p"}, {"bob"}},
+		},
+		{
+			"minus sharing only a variable of an optional block",
+			"SELECT ?p WHERE { ?p 'age' ?age MINUS { ?x 'follows' 'bob' OPTIONAL { ?x 'age' ?age } } }",
+			[][]string{{"?p"}, {"bob"}},
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if diff := deep.Equal(c.expected, actual); diff != nil {
+			t.Errorf("Error in test '%s': %v", c.comment, diff)
+		}
+	}
+
+	// variables only in a MINUS block are never bound
+	if _, err := runQuery("SELECT ?x WHERE { ?p 'age' ?age MINUS { ?x 'follows' ?p } }", hexastore); err == nil {
+		t.Error("Expected an error selecting a variable only in a MINUS block")
+	}
+}
+
+func Test_runQueryWithSelectAll(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	hexastore.Add("alice", "location", "Melbourne", "")
+
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			"every variable of a pattern",
+			"SELECT * WHERE { ?s 'age' ?o } ORDER BY ?s",
+			[][]string{{"?s", "?o"}, {"alice", "30"}, {"bob", "25"}, {"carol", "41"}},
+		},
+		{
+			"first appearance order across patterns",
+			"SELECT * WHERE { ?b 'follows' ?a . ?a 'age' ?age . ?b 'age' ?age2 FILTER(?age2 > 40) } ORDER BY ?a",
+			[][]string{{"?b", "?a", "?age", "?age2"}, {"carol", "alice", "30", "41"}, {"carol", "bob", "25", "41"}},
+		},
+		{
+			"optional variables",
+			"SELECT * WHERE { ?p 'age' ?age OPTIONAL { ?p 'location' ?loc } } ORDER BY ?p",
+			[][]string{{"?p", "?age", "?loc"}, {"alice", "30", "Melbourne"}, {"bob", "25", ""}, {"carol", "41", ""}},
+		},
+		{
+			"minus variables aren't in scope",
+			"SELECT DISTINCT * WHERE { ?p 'age' ?age MINUS { ?p 'follows' ?x } } ORDER BY ?p",
+			[][]string{{"?p", "?age"}},
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if diff := deep.Equal(c.expected, actual); diff != nil {
+			t.Errorf("Error in test '%s': %v", c.comment, diff)
+		}
+	}
+
+	actual, err := runQuery("SELECT * WHERE { ?s ?p ?o } LIMIT 1", hexastore)
+	if err != nil || len(actual) != 2 || len(actual[0]) != 3 {
+		t.Errorf("Expected one row of ?s, ?p and ?o, got %v, %v", actual, err)
+	}
+
+	if _, err := runQuery("SELECT * WHERE { ?f 'follows' ?user } GROUP BY ?user", hexastore); err == nil {
+		t.Error("Expected an error from SELECT * with GROUP BY")
+	}
+}
+
+func Test_runQueryWithRepeatedVariables(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	hexastore.Add("erin", "follows", "erin", "since 2019")
+	hexastore.Add("bob", "likes", "bob", "bob")
+	hexastore.Add("follows", "follows", "alice", "")
+
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			"self-loops of a property",
+			"SELECT ?x WHERE { ?x 'follows' ?x }",
+			[][]string{{"?x"}, {"erin"}},
+		},
+		{
+			"self-loops of any property",
+			"SELECT ?x, ?p WHERE { ?x ?p ?x } ORDER BY ?x",
+			[][]string{{"?x", "?p"}, {"bob", "likes"}, {"erin", "follows"}},
+		},
+		{
+			"subject repeated as the property",
+			"SELECT ?x, ?o WHERE { ?x ?x ?o }",
+			[][]string{{"?x", "?o"}, {"follows", "alice"}},
+		},
+		{
+			"repeated in the value",
+			"SELECT ?x WHERE { ?x ?p ?o VALUE ?x }",
+			[][]string{{"?x"}, {"bob"}},
+		},
+		{
+			"self-loop joined with another pattern",
+			"SELECT ?x, ?y WHERE { ?y 'follows' ?x . ?x 'likes' ?x }",
+			[][]string{{"?x", "?y"}, {"bob", "alice"}, {"bob", "carol"}, {"bob", "dave"}},
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := runQuery(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in test '%s': expected no error but got %s", c.comment, err)
+			continue
+		}
+		if !checkResultsEquality(c.expected, actual) || len(c.expected) != len(actual) {
+			t.Errorf("Error in test '%s': expected %v, got %v", c.comment, c.expected, actual)
+		}
+	}
+
+	// stores without reflexive iterators check every triple instead
+	union, err := runQuery("SELECT ?x, ?p WHERE { ?x ?p ?x }", hexastore.Union())
+	if err != nil || !checkResultsEquality([][]string{{"?x", "?p"}, {"bob", "likes"}, {"erin", "follows"}}, union) || len(union) != 3 {
+		t.Errorf("Expected the self-loops of the union graph, got %v, %v", union, err)
+	}
+
+	if removed := hexastore.RemoveMatching("?x", "follows", "?x"); removed != 1 {
+		t.Errorf("Expected to remove 1 self-loop, removed %d", removed)
+	}
+	if removed := hexastore.RemoveMatching("?x", "?x", "?y"); removed != 1 {
+		t.Errorf("Expected to remove 1 triple with its subject as the property, removed %d", removed)
+	}
+	hexastore.Add("carol", "knows", "knows", "")
+	if removed := hexastore.RemoveMatching("?s", "?p", "?p"); removed != 1 {
+		t.Errorf("Expected to remove 1 triple with its property as the object, removed %d", removed)
+	}
+}
+
+func TestAsk(t *testing.T) {
+	hexastore := createFollowersHexastore()
+	cases := []struct {
+		query    string
+		expected bool
+	}{
+		{"ASK { 'alice' 'follows' 'bob' }", true},
+		{"ASK WHERE { 'bob' 'follows' 'dave' }", false},
+		{"ASK { ?a 'follows' ?b . ?b 'follows' ?a }", true},
+		{"ASK { ?a 'follows' ?b ?b 'follows' ?a }", true},
+		{"ASK { ?p 'age' ?age FILTER(?age > 50) }", false},
+		{"ask { ?x 'follows' ?x }", false},
+	}
+
+	for _, c := range cases {
+		actual, err := Ask(c.query, hexastore)
+		if err != nil {
+			t.Errorf("Error in '%s': expected no error but got %s", c.query, err)
+		} else if actual != c.expected {
+			t.Errorf("Error in '%s': expected %v, got %v", c.query, c.expected, actual)
+		}
+	}
+
+	invalid := []string{
+		"SELECT ?a WHERE { ?a 'follows' 'bob' }",
+		"ASK { ?a 'follows' }",
+		"ASK { ?a 'follows' ?b FILTER(CONTAINS(?a)) }",
+	}
+	for _, query := range invalid {
+		if _, err := Ask(query, hexastore); err == nil {
+			t.Errorf("Expected an error from '%s'", query)
+		}
+	}
+}
+
+func TestAskStopsAtFirstMatch(t *testing.T) {
+	store := &countingHexastore{HexastoreDB: newHexastore()}
+	for i := 0; i < 1000; i++ {
+		store.Add(fmt.Sprintf("user%d", i), "follows", fmt.Sprintf("user%d", i+1), "")
+	}
+
+	found, err := Ask("ASK { ?a ?p ?b }", store)
+	if err != nil || !found {
+		t.Fatalf("Expected a match, got %v, %v", found, err)
+	}
+	if store.pulled != 1 {
+		t.Errorf("Expected ASK to read 1 triple, read %d", store.pulled)
+	}
+}
+
+func TestAskContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := AskContext(ctx, "ASK { ?a ?p ?b }", createFollowersHexastore()); err != ErrQueryCanceled {
+		t.Errorf("Expected ErrQueryCanceled, got %v", err)
+	}
+}
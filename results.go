@@ -0,0 +1,75 @@
+package simplegraphdb
+
+// unboundCell is how RunQuery's table shows a variable left unbound by a
+// solution, such as one only bound by an OPTIONAL block which didn't match
+const unboundCell = "(unbound)"
+
+// ResultSet holds the solutions to a query: a row for each solution, with a
+// binding in each row for each of the query's variables
+type ResultSet struct {
+	Vars []string
+	Rows [][]Binding
+}
+
+// Binding is the term a variable was bound to in a solution. Bound is false
+// when the solution leaves the variable unbound
+type Binding struct {
+	Term  Term
+	Bound bool
+}
+
+func buildResultSet(returnVars []string, solutions solutionIterator) (*ResultSet, error) {
+	results := &ResultSet{Vars: returnVars, Rows: [][]Binding{}}
+
+	for solutions.next() {
+		sol := solutions.solution()
+		row := make([]Binding, len(returnVars))
+		for j, rVar := range returnVars {
+			if val, ok := sol[rVar]; ok {
+				row[j] = Binding{Term: ParseTerm(val), Bound: true}
+			}
+		}
+		results.Rows = append(results.Rows, row)
+	}
+	if err := solutions.err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// Grid gives the results as a grid of strings, with a header row of the
+// variable names followed by each row's terms in the form written by
+// Term.String, except for plain literals which are given as the strings they
+// hold. Unbound variables are given as empty strings, so only Rows tells them
+// apart from variables bound to an empty literal. It's the input to
+// PresentResultGrid
+func (results *ResultSet) Grid() [][]string {
+	return results.grid("")
+}
+
+// grid is Grid, giving unbound for unbound variables
+func (results *ResultSet) grid(unbound string) [][]string {
+	grid := make([][]string, len(results.Rows)+1)
+	grid[0] = results.Vars // add header
+
+	for i, row := range results.Rows {
+		grid[i+1] = make([]string, len(row))
+		for j, binding := range row {
+			if binding.Bound {
+				grid[i+1][j] = gridCell(binding.Term)
+			} else {
+				grid[i+1][j] = unbound
+			}
+		}
+	}
+
+	return grid
+}
+
+func gridCell(t Term) string {
+	if t.Kind == LiteralTerm && t.Lang == "" && t.Datatype == "" {
+		return t.Value
+	}
+	return t.String()
+}
@@ -0,0 +1,81 @@
+package simplegraphdb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestQueryResultSet(t *testing.T) {
+	h := newHexastore()
+	fr := NewIRI("http://example.org/fr")
+	h.AddTerms(fr, NewIRI("http://example.org/name"), NewLangLiteral("France", "fr"), "official")
+	h.AddTerms(NewBlankNode("b0"), NewIRI("http://example.org/locatedIn"), fr, "")
+
+	results, err := Query("SELECT ?name, ?v WHERE { ?x <http://example.org/name> ?name VALUE ?v }", h)
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+
+	expected := &ResultSet{
+		Vars: []string{"?name", "?v"},
+		Rows: [][]Binding{
+			{{Term: NewLangLiteral("France", "fr"), Bound: true}, {Term: NewLiteral("official"), Bound: true}},
+		},
+	}
+	if diff := deep.Equal(expected, results); diff != nil {
+		t.Error(diff)
+	}
+
+	results, err = Query("SELECT ?x WHERE { ?x <http://example.org/locatedIn> ?y }", h)
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+	if len(results.Rows) != 1 || results.Rows[0][0].Term.Kind != BlankTerm {
+		t.Errorf("Expected a single blank node, got %v", results.Rows)
+	}
+}
+
+func TestQueryResultSetEmpty(t *testing.T) {
+	results, err := Query("SELECT ?x WHERE { ?x 'Likes' 'Nothing' }", createTestHexastore())
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+
+	if diff := deep.Equal([][]string{{"?x"}}, results.Grid()); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestQueryResultSetUnbound(t *testing.T) {
+	h := newHexastore()
+	h.Add("alice", "name", "", "")
+	h.Add("bob", "age", "25", "")
+
+	query := "SELECT ?p, ?name WHERE { ?p ?prop ?o OPTIONAL { ?p 'name' ?name } } ORDER BY ?p"
+	results, err := Query(query, h)
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+	if len(results.Rows) != 2 || !results.Rows[0][1].Bound || results.Rows[1][1].Bound {
+		t.Fatalf("Expected alice's empty name to be bound and bob's to be unbound, got %v", results.Rows)
+	}
+	if diff := deep.Equal([][]string{{"?p", "?name"}, {"alice", ""}, {"bob", ""}}, results.Grid()); diff != nil {
+		t.Error(diff)
+	}
+
+	table, err := RunQuery(query, h)
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+	if strings.Count(table, unboundCell) != 1 {
+		t.Errorf("Expected only bob's name to be shown as unbound, got\n%s", table)
+	}
+}
+
+func TestQueryInvalid(t *testing.T) {
+	if _, err := Query("SELECT WHERE { ?x 'Likes' 'Banana' }", createTestHexastore()); err == nil {
+		t.Error("Expected an error from a malformed query")
+	}
+}
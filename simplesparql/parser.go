@@ -9,14 +9,17 @@ import (
 
 var (
 	sqlLexer = lexer.Unquote(lexer.Upper(lexer.Must(lexer.Regexp(`(\s+)`+
-		`|(?P<Keyword>(?i)SELECT|FROM|DISTINCT|ALL|WHERE|GROUP|BY|MINUS|EXCEPT|INTERSECT|ORDER|LIMIT|OFFSET|TRUE|FALSE|NULL|IS|NOT|ANY|BETWEEN|AND|OR|LIKE|AS|IN)`+
+		`|(?P<Keyword>(?i)\b(SELECT|ASK|FROM|GRAPH|OPTIONAL|UNION|FILTER|REGEX|CONTAINS|STRSTARTS|LANG|DISTINCT|ALL|WHERE|GROUP|BY|HAVING|COUNT|SUM|MIN|MAX|AVG|MINUS|EXCEPT|INTERSECT|ORDER|ASC|DESC|LIMIT|OFFSET|VALUE|TRUE|FALSE|NULL|IS|NOT|ANY|BETWEEN|AND|OR|LIKE|AS|IN)\b)`+
 		`|(?P<Ident>[a-zA-Z_][a-zA-Z0-9_]*)`+
 		`|(?P<Variable>\?[a-zA-Z_][a-zA-Z0-9_]*)`+
 		`|(?P<Number>[-+]?\d*\.?\d+([eE][-+]?\d+)?)`+
 		`|(?P<String>'[^']*'|"[^"]*")`+
-		`|(?P<Operators><>|!=|<=|>=|[-+*/%,.(){}=<>])`,
+		`|(?P<IRI><[^<>\s]+>)`+
+		`|(?P<LangTag>@[a-zA-Z]+(-[a-zA-Z0-9]+)*)`+
+		`|(?P<Operators><>|!=|<=|>=|\^\^|&&|\|\||[-+*/%,.(){}=<>!])`,
 	)), "Keyword"), "String")
-	sqlParser = participle.MustBuild(&Select{}, sqlLexer)
+	sqlParser   = participle.MustBuild(&Select{}, sqlLexer)
+	queryParser = participle.MustBuild(&Query{}, sqlLexer)
 )
 
 type Boolean bool
@@ -26,6 +29,17 @@ func (b *Boolean) Capture(values []string) error {
 	return nil
 }
 
+// Query is either a SELECT or an ASK query
+type Query struct {
+	Ask    *Ask    `  @@`
+	Select *Select `| @@`
+}
+
+// Ask asks whether a group pattern has any solutions
+type Ask struct {
+	Group *GroupPattern `"ASK" [ "WHERE" ] @@`
+}
+
 // Select, based on http://www.h2database.com/html/grammar.html
 type Select struct {
 	Top        *Term             `"SELECT" [ "TOP" @@ ]`
@@ -33,37 +47,104 @@ type Select struct {
 	All        bool              ` | @"ALL" ]`
 	Expression *SelectExpression `@@`
 	Where      *Where            `@@`
-	Limit      *Expression       `[ "LIMIT" @@ ]`
-	Offset     *Expression       `[ "OFFSET" @@ ]`
-	GroupBy    *Expression       `[ "GROUP" "BY" @@ ]`
+	GroupBy    []string          `[ "GROUP" "BY" @Variable { @Variable } ]`
+	Having     *Expression       `[ "HAVING" @@ ]`
+	OrderBy    []*OrderCondition `[ "ORDER" "BY" @@ { @@ } ]`
+	Limit      *float64          `[ "LIMIT" @Number ]`
+	Offset     *float64          `[ "OFFSET" @Number ]`
 }
 
 type Where struct {
-	Expression *TripleExpression `"WHERE" "{" @@ "}"`
+	Group *GroupPattern `"WHERE" @@`
+}
+
+// GroupPattern is a group of triple patterns separated by '.', which are
+// joined on their shared variables, GRAPH, OPTIONAL, MINUS and nested blocks
+// and FILTERs
+type GroupPattern struct {
+	Elements []*GroupElement `"{" { @@ } "}"`
+}
+
+type GroupElement struct {
+	Graph    *GraphPattern     `  @@ [ "." ]`
+	Optional *GroupPattern     `| "OPTIONAL" @@ [ "." ]`
+	Minus    *GroupPattern     `| "MINUS" @@ [ "." ]`
+	Filter   *Expression       `| "FILTER" @@ [ "." ]`
+	Union    *UnionPattern     `| @@ [ "." ]`
+	Triple   *TripleExpression `| @@ [ "." ]`
+}
+
+// UnionPattern is a nested group, or several groups separated by UNION which
+// are each matched in turn
+type UnionPattern struct {
+	Groups []*GroupPattern `@@ { "UNION" @@ }`
+}
+
+// GraphPattern matches a group against a named graph, or every named
+// graph when its name is a variable
+type GraphPattern struct {
+	Name  *TripleTerm   `"GRAPH" @@`
+	Group *GroupPattern `@@`
+}
+
+// OrderCondition is a sort key of an ORDER BY clause, either a variable,
+// which sorts ascending, or ASC(?x) or DESC(?x)
+type OrderCondition struct {
+	Directed *DirectedOrder `  @@`
+	Var      string         `| @Variable`
+}
+
+type DirectedOrder struct {
+	Direction string `@( "ASC" | "DESC" )`
+	Var       string `"(" @Variable ")"`
 }
 
 type SelectExpression struct {
 	All         bool          `  @"*"`
-	Expressions []*Expression `| @@ { "," @@ }`
+	Projections []*Projection `| @@ { [ "," ] @@ }`
 }
 
+// Projection is a selected variable, or an aggregate bound to a new
+// variable, eg. (COUNT(?f) AS ?followers)
+type Projection struct {
+	Var       string               `  @Variable`
+	Aggregate *AggregateProjection `| "(" @@ ")"`
+}
+
+type AggregateProjection struct {
+	Aggregate *Aggregate `@@`
+	As        string     `"AS" @Variable`
+}
+
+// Aggregate computes a value from each group of solutions, eg. COUNT(?f),
+// COUNT(DISTINCT ?f) or COUNT(*)
+type Aggregate struct {
+	Function string `@( "COUNT" | "SUM" | "MIN" | "MAX" | "AVG" )`
+	Distinct bool   `"(" [ @"DISTINCT" ]`
+	All      bool   `(  @"*"`
+	Var      string ` | @Variable ) ")"`
+}
+
+// TripleExpression is a triple pattern, optionally followed by VALUE and a
+// term matching the value stored with each triple
 type TripleExpression struct {
 	First  *TripleTerm ` @@`
 	Second *TripleTerm ` @@`
 	Third  *TripleTerm ` @@`
+	Value  *TripleTerm `[ "VALUE" @@ ]`
 }
 
 type Expression struct {
-	And *AndCondition `@@ { "OR" @@ }`
+	And []*AndCondition `@@ { ( "OR" | "||" ) @@ }`
 }
 
 type AndCondition struct {
-	Or []*Condition `@@ { "AND" @@ }`
+	Or []*Condition `@@ { ( "AND" | "&&" ) @@ }`
 }
 
 type Condition struct {
 	Operand *ConditionOperand `  @@`
-	Not     *Condition        `| "NOT" @@`
+	Not     *Condition        `| ( "NOT" | "!" ) @@`
 	Exists  *Select           `| "EXISTS" "(" @@ ")"`
 }
 
@@ -96,7 +177,7 @@ type In struct {
 }
 
 type Operand struct {
-	Summand []*Summand `@@ { "|" "|" @@ }`
+	Summand *Summand `@@`
 }
 
 type Summand struct {
@@ -118,10 +199,26 @@ type Term struct {
 	SubExpression *Expression `| "(" @@ ")"`
 }
 
+// TripleTerm is a variable, an IRI such as <http://example.org/a>, or a
+// value, which may be a string literal tagged with a language ('France'@fr)
+// or a datatype ('12'^^<http://www.w3.org/2001/XMLSchema#int>). In a FILTER
+// or HAVING expression it can also be a function call, and in a HAVING
+// expression an aggregate
 type TripleTerm struct {
-	Var           string      `| @Variable`
-	Value         *Value      `| @@`
-	SubExpression *Expression `| "(" @@ ")"`
+	Var           string        `| @Variable`
+	IRI           string        `| @IRI`
+	Value         *Value        `| @@`
+	Lang          string        `  [ @LangTag`
+	Datatype      string        `  | "^^" @IRI ]`
+	SubExpression *Expression   `| "(" @@ ")"`
+	Aggregate     *Aggregate    `| @@`
+	Call          *FunctionCall `| @@`
+}
+
+// FunctionCall is a call to a built in function, eg. REGEX(?name, '^a', 'i')
+type FunctionCall struct {
+	Function  string        `@( "REGEX" | "CONTAINS" | "STRSTARTS" | "LANG" )`
+	Arguments []*Expression `"(" [ @@ { "," @@ } ] ")"`
 }
 
 type SymbolRef struct {
@@ -153,3 +250,14 @@ func Parse(query string) (*Select, error) {
 
 	return sql, nil
 }
+
+// ParseQuery parses either a SELECT or an ASK query
+func ParseQuery(query string) (*Query, error) {
+	q := &Query{}
+	err := queryParser.ParseString(query, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
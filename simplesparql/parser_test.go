@@ -0,0 +1,55 @@
+package simplesparql
+
+import "testing"
+
+func TestParseTriplePatterns(t *testing.T) {
+	cases := []struct {
+		comment  string
+		query    string
+		patterns int
+		values   int
+	}{
+		{"two patterns without '.'", "SELECT ?a WHERE { ?a 'follows' ?b ?b 'follows' ?a }", 2, 0},
+		{"two patterns with '.'", "SELECT ?a WHERE { ?a 'follows' ?b . ?b 'follows' ?a }", 2, 0},
+		{"value", "SELECT ?a WHERE { ?a 'follows' ?b VALUE ?since }", 1, 1},
+		{"value followed by '.'", "SELECT ?a WHERE { ?a 'follows' ?b VALUE ?since . ?b 'follows' ?a }", 2, 1},
+		{"value followed by a pattern", "SELECT ?a WHERE { ?a 'follows' ?b VALUE ?since ?b 'follows' ?a }", 2, 1},
+		{"value followed by a FILTER", "SELECT ?a WHERE { ?a 'follows' ?b VALUE ?since FILTER(?since != '') }", 1, 1},
+	}
+
+	for _, c := range cases {
+		query, err := Parse(c.query)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", c.comment, err)
+			continue
+		}
+
+		patterns, values := 0, 0
+		for _, elem := range query.Where.Group.Elements {
+			if elem.Triple == nil {
+				continue
+			}
+			patterns++
+			if elem.Triple.Value != nil {
+				values++
+			}
+		}
+		if patterns != c.patterns || values != c.values {
+			t.Errorf("%s: expected %d patterns with %d values, got %d with %d", c.comment, c.patterns, c.values, patterns, values)
+		}
+	}
+
+	invalid := []string{
+		"SELECT ?a WHERE { ?a 'follows' ?b ?since }",
+		"SELECT ?a WHERE { ?a 'follows' ?b ?since . ?b 'follows' ?a }",
+		"SELECT ?a WHERE { ?a 'follows' ?b VALUE }",
+	}
+	for _, query := range invalid {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("Expected an error parsing '%s'", query)
+		}
+	}
+	if _, err := ParseQuery("ASK { OPTIONAL { ?a 'follows' } }"); err == nil {
+		t.Error("Expected an error parsing a nested pattern of two terms")
+	}
+}
@@ -0,0 +1,296 @@
+package simplegraphdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The snapshot format is a magic header and version followed by the entity
+// dictionary, the property dictionary, with terms written as strings in the
+// form of Term.String, the ID triples of the default graph and
+// then each named graph's entity ID and ID triples. Integers are written as
+// uvarints and strings are length prefixed. The file ends with a CRC-32 of
+// everything before it. Version 1 files, written before named graphs, end
+// after the default graph's triples. Version 1 and 2 files, written before
+// terms, hold the raw strings values were added with, which are read back
+// as plain literals.
+const (
+	snapshotMagic   = "SGDBSNAP"
+	snapshotVersion = 3
+)
+
+// ErrCorruptSnapshot is returned when a snapshot file is truncated or
+// fails its checksum
+var ErrCorruptSnapshot = errors.New("snapshot file is truncated or corrupt")
+
+// ErrSnapshotVersion is returned when a snapshot file was written in a
+// format version this package can't read
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) write(p []byte) {
+	if sw.err != nil {
+		return
+	}
+	sw.crc.Write(p)
+	_, sw.err = sw.w.Write(p)
+}
+
+func (sw *snapshotWriter) writeUint(v uint64) {
+	n := binary.PutUvarint(sw.buf[:], v)
+	sw.write(sw.buf[:n])
+}
+
+func (sw *snapshotWriter) writeString(s string) {
+	sw.writeUint(uint64(len(s)))
+	sw.write([]byte(s))
+}
+
+func (sw *snapshotWriter) writeDictionary(dict *Dictionary) {
+	ids := make([]int, 0, len(dict.m))
+	for id := range dict.m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	sw.writeUint(uint64(dict.NextKey))
+	sw.writeUint(uint64(len(ids)))
+	for _, id := range ids {
+		sw.writeUint(uint64(id))
+		sw.writeString(dict.m[id].String())
+	}
+}
+
+func (sw *snapshotWriter) writeTriples(store *HexastoreDB) {
+	count := 0
+	for _, propMap := range store.SPO {
+		for _, objMap := range propMap {
+			count += len(objMap)
+		}
+	}
+
+	sw.writeUint(uint64(count))
+	for subjID, propMap := range store.SPO {
+		for propID, objMap := range propMap {
+			for objID, value := range objMap {
+				sw.writeUint(uint64(subjID))
+				sw.writeUint(uint64(propID))
+				sw.writeUint(uint64(objID))
+				sw.writeString(value)
+			}
+		}
+	}
+}
+
+// SaveSnapshot writes a store, including the IDs its dictionaries have assigned,
+// to a compact binary file which can be reopened with InitHexastoreFromSnapshot.
+// The file is written alongside the destination and renamed into place, so an
+// existing snapshot is never left half overwritten
+func SaveSnapshot(dbFilePath string, store *HexastoreDB) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	return writeSnapshot(dbFilePath, store)
+}
+
+// writeSnapshot does the work of SaveSnapshot. The caller must hold the store's lock
+func writeSnapshot(dbFilePath string, store *HexastoreDB) error {
+	file, err := ioutil.TempFile(filepath.Dir(dbFilePath), filepath.Base(dbFilePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	sw := &snapshotWriter{w: bufio.NewWriter(file), crc: crc32.NewIEEE()}
+
+	sw.write([]byte(snapshotMagic))
+	sw.writeUint(snapshotVersion)
+	sw.writeDictionary(&store.entities.Dictionary)
+	sw.writeDictionary(&store.props.Dictionary)
+
+	store = store.rootGraph()
+	sw.writeTriples(store)
+
+	sw.writeUint(uint64(len(store.graphs)))
+	for id, graph := range store.graphs {
+		sw.writeUint(uint64(id))
+		sw.writeTriples(graph)
+	}
+
+	if sw.err == nil {
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], sw.crc.Sum32())
+		_, sw.err = sw.w.Write(sum[:])
+	}
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	if sw.err == nil {
+		sw.err = file.Sync()
+	}
+	if err = file.Close(); sw.err == nil {
+		sw.err = err
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+
+	return os.Rename(file.Name(), dbFilePath)
+}
+
+type snapshotReader struct {
+	r    *bufio.Reader
+	crc  hash.Hash32
+	size uint64 // bounds string lengths so corrupt files can't force huge allocations
+	err  error
+}
+
+func (sr *snapshotReader) fail(err error) {
+	if sr.err != nil {
+		return
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrCorruptSnapshot
+	}
+	sr.err = err
+}
+
+// ReadByte lets binary.ReadUvarint read through the reader while the checksum is kept
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (sr *snapshotReader) read(n uint64) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	if n > sr.size {
+		sr.fail(ErrCorruptSnapshot)
+		return nil
+	}
+
+	p := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, p); err != nil {
+		sr.fail(err)
+		return nil
+	}
+	sr.crc.Write(p)
+	return p
+}
+
+func (sr *snapshotReader) readUint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(sr)
+	if err != nil {
+		sr.fail(err)
+	}
+	return v
+}
+
+func (sr *snapshotReader) readInt() int {
+	v := sr.readUint()
+	if v > uint64(^uint(0)>>1) {
+		sr.fail(ErrCorruptSnapshot)
+		return 0
+	}
+	return int(v)
+}
+
+func (sr *snapshotReader) readString() string {
+	return string(sr.read(sr.readUint()))
+}
+
+func (sr *snapshotReader) readDictionary(dict *Dictionary, version uint64) {
+	dict.NextKey = sr.readInt()
+	count := sr.readUint()
+	for i := uint64(0); i < count && sr.err == nil; i++ {
+		id := sr.readInt()
+		var t Term
+		if version >= 3 {
+			t = ParseTerm(sr.readString())
+		} else {
+			t = NewLiteral(sr.readString())
+		}
+		dict.m[id] = t
+		dict.keys[t] = id
+	}
+}
+
+func (sr *snapshotReader) readTriples(store *HexastoreDB) {
+	count := sr.readUint()
+	for i := uint64(0); i < count && sr.err == nil; i++ {
+		subjID, propID, objID := sr.readInt(), sr.readInt(), sr.readInt()
+		value := sr.readString()
+		store.add(MakeTriple(subjID, propID, objID, value))
+	}
+}
+
+// InitHexastoreFromSnapshot creates a new hexastore from a file written by
+// SaveSnapshot. Entities and properties keep the IDs they had when saved
+func InitHexastoreFromSnapshot(dbFilePath string) (*HexastoreDB, error) {
+	file, err := os.Open(dbFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sr := &snapshotReader{r: bufio.NewReader(file), crc: crc32.NewIEEE(), size: uint64(info.Size())}
+	if string(sr.read(uint64(len(snapshotMagic)))) != snapshotMagic {
+		sr.fail(ErrCorruptSnapshot)
+	}
+	version := sr.readUint()
+	if sr.err == nil && (version < 1 || version > snapshotVersion) {
+		return nil, ErrSnapshotVersion
+	}
+
+	store := newHexastore()
+	sr.readDictionary(&store.entities.Dictionary, version)
+	sr.readDictionary(&store.props.Dictionary, version)
+
+	sr.readTriples(store)
+
+	if version >= 2 {
+		count := sr.readUint()
+		for i := uint64(0); i < count && sr.err == nil; i++ {
+			sr.readTriples(store.graphWithID(sr.readInt()))
+		}
+	}
+	if sr.err != nil {
+		return nil, sr.err
+	}
+
+	var sum [4]byte
+	if _, err = io.ReadFull(sr.r, sum[:]); err != nil || binary.BigEndian.Uint32(sum[:]) != sr.crc.Sum32() {
+		return nil, ErrCorruptSnapshot
+	}
+	if _, err = sr.r.ReadByte(); err != io.EOF {
+		return nil, ErrCorruptSnapshot
+	}
+
+	return store, nil
+}
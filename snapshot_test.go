@@ -0,0 +1,189 @@
+package simplegraphdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func saveTestSnapshot(t *testing.T, dir string) (*HexastoreDB, string) {
+	original := createRoundTripHexastore()
+	original.Add("carol", "follows", "dave", "since 2017")
+	dbFilePath := filepath.Join(dir, "db.snapshot")
+
+	if err := SaveSnapshot(dbFilePath, original); err != nil {
+		t.Fatal("Expected no error saving snapshot, got ", err)
+	}
+
+	return original, dbFilePath
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original, dbFilePath := saveTestSnapshot(t, dir)
+
+	reloaded, err := InitHexastoreFromSnapshot(dbFilePath)
+	if err != nil {
+		t.Fatal("Expected no error reloading snapshot, got ", err)
+	}
+
+	if diff := deep.Equal(original.SPO, reloaded.SPO); diff != nil {
+		t.Error("Reloaded triples differ: ", diff)
+	}
+	if diff := deep.Equal(original.entities.m, reloaded.entities.m); diff != nil {
+		t.Error("Reloaded entity IDs differ: ", diff)
+	}
+	if diff := deep.Equal(original.props.m, reloaded.props.m); diff != nil {
+		t.Error("Reloaded property IDs differ: ", diff)
+	}
+
+	// new values carry on from the saved IDs rather than reusing them
+	reloaded.Add("erin", "follows", "alice", "")
+	if id, _ := reloaded.GetEntityKey("erin"); id != original.entities.NextKey {
+		t.Errorf("Expected new entity to get ID %d, got %d", original.entities.NextKey, id)
+	}
+}
+
+func TestSnapshotDetectsTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, dbFilePath := saveTestSnapshot(t, dir)
+	dat, err := ioutil.ReadFile(dbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	truncatedPath := filepath.Join(dir, "truncated.snapshot")
+	for size := 0; size < len(dat); size++ {
+		if err := ioutil.WriteFile(truncatedPath, dat[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := InitHexastoreFromSnapshot(truncatedPath); err != ErrCorruptSnapshot {
+			t.Errorf("Expected '%v' for snapshot truncated to %d bytes, got '%v'", ErrCorruptSnapshot, size, err)
+		}
+	}
+}
+
+func TestSnapshotDetectsCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, dbFilePath := saveTestSnapshot(t, dir)
+	dat, err := ioutil.ReadFile(dbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat[len(dat)/2] ^= 0xff
+	if err := ioutil.WriteFile(dbFilePath, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InitHexastoreFromSnapshot(dbFilePath); err == nil {
+		t.Error("Expected an error loading a corrupted snapshot")
+	}
+}
+
+func TestSnapshotUnsupportedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbFilePath := filepath.Join(dir, "db.snapshot")
+	if err := ioutil.WriteFile(dbFilePath, []byte(snapshotMagic+"\x63"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InitHexastoreFromSnapshot(dbFilePath); err != ErrSnapshotVersion {
+		t.Errorf("Expected '%v', got '%v'", ErrSnapshotVersion, err)
+	}
+}
+
+func TestSnapshotReadsVersion2AsPlainLiterals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a version 2 file holds the raw strings values were added with
+	file, err := os.Create(filepath.Join(dir, "db.snapshot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := &snapshotWriter{w: bufio.NewWriter(file), crc: crc32.NewIEEE()}
+	sw.write([]byte(snapshotMagic))
+	sw.writeUint(2)
+	entities := []string{"alice", "<bob>", `"carol"`}
+	sw.writeUint(uint64(len(entities)))
+	sw.writeUint(uint64(len(entities)))
+	for id, entity := range entities {
+		sw.writeUint(uint64(id))
+		sw.writeString(entity)
+	}
+	sw.writeUint(1)
+	sw.writeUint(1)
+	sw.writeUint(0)
+	sw.writeString("follows")
+	sw.writeUint(2)
+	for _, objID := range []uint64{1, 2} {
+		sw.writeUint(0)
+		sw.writeUint(0)
+		sw.writeUint(objID)
+		sw.writeString("")
+	}
+	sw.writeUint(0)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], sw.crc.Sum32())
+	sw.w.Write(sum[:])
+	if err := sw.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	store, err := InitHexastoreFromSnapshot(file.Name())
+	if err != nil {
+		t.Fatal("Expected no error reloading a version 2 snapshot, got ", err)
+	}
+	for id, entity := range entities {
+		if got := store.entities.m[id]; got != NewLiteral(entity) {
+			t.Errorf("Expected entity %d to be the plain literal %q, got %v", id, entity, got)
+		}
+	}
+
+	// resaving writes the current version, which reads back the same terms
+	dbFilePath := filepath.Join(dir, "resaved.snapshot")
+	if err := SaveSnapshot(dbFilePath, store); err != nil {
+		t.Fatal(err)
+	}
+	resaved, err := InitHexastoreFromSnapshot(dbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(store.entities.m, resaved.entities.m); diff != nil {
+		t.Error("Resaved entities differ: ", diff)
+	}
+	if diff := deep.Equal(store.SPO, resaved.SPO); diff != nil {
+		t.Error("Resaved triples differ: ", diff)
+	}
+}
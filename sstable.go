@@ -0,0 +1,393 @@
+package simplegraphdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The on-disk store is a small log-structured merge tree. Updates go into a
+// sorted in-memory table which is flushed to an immutable, sorted segment file
+// once it grows large enough. Reads merge the table with every segment, with
+// newer entries shadowing older ones and tombstones marking deletions.
+//
+// A segment file holds its entries in key order, each as a uvarint key length,
+// the key, a tombstone flag byte, a uvarint value length and the value. After
+// the entries comes a sparse index of every segmentIndexInterval'th key and its
+// offset, then a footer of the index's offset and length and a magic trailer.
+const (
+	segmentMagic         = "SGDBSST1"
+	segmentFooterSize    = 8 + 8 + len(segmentMagic)
+	segmentIndexInterval = 64
+)
+
+// ErrCorruptSegment is returned when an on-disk segment file can't be read
+var ErrCorruptSegment = errors.New("segment file is truncated or corrupt")
+
+type lsmEntry struct {
+	key       string
+	value     string
+	tombstone bool
+}
+
+// lsmIterator walks entries in key order
+type lsmIterator interface {
+	next() bool
+	entry() lsmEntry
+	err() error
+}
+
+// memtable is the sorted in-memory table of the most recent updates
+type memtable struct {
+	entries []lsmEntry
+}
+
+func (m *memtable) seek(key string) int {
+	return sort.Search(len(m.entries), func(i int) bool { return m.entries[i].key >= key })
+}
+
+func (m *memtable) put(e lsmEntry) {
+	i := m.seek(e.key)
+	if i < len(m.entries) && m.entries[i].key == e.key {
+		m.entries[i] = e
+		return
+	}
+
+	m.entries = append(m.entries, lsmEntry{})
+	copy(m.entries[i+1:], m.entries[i:])
+	m.entries[i] = e
+}
+
+// scan iterates over the table's entries starting from the first key >= start
+func (m *memtable) scan(start string) lsmIterator {
+	return &sliceIterator{entries: m.entries[m.seek(start):], pos: -1}
+}
+
+type sliceIterator struct {
+	entries []lsmEntry
+	pos     int
+}
+
+func (it *sliceIterator) next() bool {
+	it.pos++
+	return it.pos < len(it.entries)
+}
+
+func (it *sliceIterator) entry() lsmEntry { return it.entries[it.pos] }
+
+func (it *sliceIterator) err() error { return nil }
+
+type segmentIndexEntry struct {
+	key    string
+	offset int64
+}
+
+// segment is an immutable sorted file of entries. Only its sparse index is
+// kept in memory
+type segment struct {
+	seq     int
+	path    string
+	file    *os.File
+	index   []segmentIndexEntry
+	dataEnd int64
+}
+
+func segmentPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("segment-%09d.sst", seq))
+}
+
+// writeSegment writes every entry of an iterator to a new segment file, renamed
+// into place once complete. Tombstones are dropped when nothing older than the
+// iterator's entries remains for them to shadow
+func writeSegment(path string, it lsmIterator, dropTombstones bool) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	w := bufio.NewWriter(file)
+	var buf [binary.MaxVarintLen64]byte
+	var offset int64
+	var index []segmentIndexEntry
+	count := 0
+
+	write := func(p []byte) {
+		if err == nil {
+			_, err = w.Write(p)
+			offset += int64(len(p))
+		}
+	}
+	writeUint := func(v uint64) {
+		write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	writeString := func(s string) {
+		writeUint(uint64(len(s)))
+		write([]byte(s))
+	}
+
+	for it.next() {
+		e := it.entry()
+		if e.tombstone && dropTombstones {
+			continue
+		}
+		if count%segmentIndexInterval == 0 {
+			index = append(index, segmentIndexEntry{key: e.key, offset: offset})
+		}
+		count++
+
+		writeString(e.key)
+		if e.tombstone {
+			write([]byte{1})
+		} else {
+			write([]byte{0})
+		}
+		writeString(e.value)
+	}
+	if err == nil {
+		err = it.err()
+	}
+
+	indexOffset := offset
+	for _, ie := range index {
+		writeString(ie.key)
+		writeUint(uint64(ie.offset))
+	}
+
+	var footer [16]byte
+	binary.BigEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.BigEndian.PutUint64(footer[8:16], uint64(offset-indexOffset))
+	write(footer[:])
+	write([]byte(segmentMagic))
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func openSegment(path string, seq int) (*segment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seg, err := loadSegmentIndex(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg.seq, seg.path, seg.file = seq, path, file
+
+	return seg, nil
+}
+
+func loadSegmentIndex(file *os.File) (*segment, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < int64(segmentFooterSize) {
+		return nil, ErrCorruptSegment
+	}
+
+	footer := make([]byte, segmentFooterSize)
+	if _, err = file.ReadAt(footer, info.Size()-int64(segmentFooterSize)); err != nil {
+		return nil, err
+	}
+	if string(footer[16:]) != segmentMagic {
+		return nil, ErrCorruptSegment
+	}
+
+	indexOffset := int64(binary.BigEndian.Uint64(footer[0:8]))
+	indexSize := int64(binary.BigEndian.Uint64(footer[8:16]))
+	if indexOffset < 0 || indexSize < 0 || indexOffset+indexSize != info.Size()-int64(segmentFooterSize) {
+		return nil, ErrCorruptSegment
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(file, indexOffset, indexSize))
+	seg := &segment{dataEnd: indexOffset}
+	for {
+		key, err := readSegmentString(r, indexSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, ErrCorruptSegment
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil || int64(offset) > indexOffset {
+			return nil, ErrCorruptSegment
+		}
+		seg.index = append(seg.index, segmentIndexEntry{key: key, offset: int64(offset)})
+	}
+
+	return seg, nil
+}
+
+// readSegmentString reads a length prefixed string, with limit bounding its
+// length so a corrupt file can't force a huge allocation
+func readSegmentString(r *bufio.Reader, limit int64) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if int64(n) > limit || int64(n) < 0 {
+		return "", ErrCorruptSegment
+	}
+
+	p := make([]byte, n)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return "", ErrCorruptSegment
+	}
+	return string(p), nil
+}
+
+// scan iterates over the segment's entries starting from the first key >= start
+func (seg *segment) scan(start string) lsmIterator {
+	// start from the last indexed key at or before start
+	i := sort.Search(len(seg.index), func(i int) bool { return seg.index[i].key > start }) - 1
+	var offset int64
+	if i >= 0 {
+		offset = seg.index[i].offset
+	}
+
+	section := io.NewSectionReader(seg.file, offset, seg.dataEnd-offset)
+	return &segmentIterator{r: bufio.NewReader(section), limit: seg.dataEnd, start: start}
+}
+
+type segmentIterator struct {
+	r       *bufio.Reader
+	limit   int64
+	start   string
+	current lsmEntry
+	failure error
+}
+
+func (it *segmentIterator) next() bool {
+	for it.failure == nil {
+		key, err := readSegmentString(it.r, it.limit)
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			it.failure = ErrCorruptSegment
+			return false
+		}
+
+		flag, err := it.r.ReadByte()
+		if err != nil {
+			it.failure = ErrCorruptSegment
+			return false
+		}
+		value, err := readSegmentString(it.r, it.limit)
+		if err != nil {
+			it.failure = ErrCorruptSegment
+			return false
+		}
+
+		if key >= it.start {
+			it.current = lsmEntry{key: key, value: value, tombstone: flag == 1}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (it *segmentIterator) entry() lsmEntry { return it.current }
+
+func (it *segmentIterator) err() error { return it.failure }
+
+// mergeIterator merges several iterators into one, ordered by key. Where more
+// than one holds the same key the entry from the earliest iterator wins, so
+// iterators should be given newest first
+type mergeIterator struct {
+	its     []lsmIterator
+	valid   []bool
+	started bool
+	current lsmEntry
+}
+
+func newMergeIterator(its []lsmIterator) *mergeIterator {
+	return &mergeIterator{its: its, valid: make([]bool, len(its))}
+}
+
+func (it *mergeIterator) next() bool {
+	if !it.started {
+		it.started = true
+		for i, sub := range it.its {
+			it.valid[i] = sub.next()
+		}
+	} else {
+		// advance every iterator past the key just returned
+		for i, sub := range it.its {
+			if it.valid[i] && sub.entry().key == it.current.key {
+				it.valid[i] = sub.next()
+			}
+		}
+	}
+
+	smallest := -1
+	for i, sub := range it.its {
+		if it.valid[i] && (smallest < 0 || sub.entry().key < it.its[smallest].entry().key) {
+			smallest = i
+		}
+	}
+	if smallest < 0 || it.err() != nil {
+		return false
+	}
+
+	it.current = it.its[smallest].entry()
+	return true
+}
+
+func (it *mergeIterator) entry() lsmEntry { return it.current }
+
+func (it *mergeIterator) err() error {
+	for _, sub := range it.its {
+		if err := sub.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// liveIterator hides tombstones and stops at the end of a key prefix
+type liveIterator struct {
+	it     lsmIterator
+	prefix string
+}
+
+func (it *liveIterator) next() bool {
+	for it.it.next() {
+		e := it.it.entry()
+		if len(e.key) < len(it.prefix) || e.key[:len(it.prefix)] != it.prefix {
+			return false
+		}
+		if !e.tombstone {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *liveIterator) entry() lsmEntry { return it.it.entry() }
+
+func (it *liveIterator) err() error { return it.it.err() }
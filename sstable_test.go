@@ -0,0 +1,113 @@
+package simplegraphdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func collectEntries(t *testing.T, it lsmIterator) []lsmEntry {
+	entries := []lsmEntry{}
+	for it.next() {
+		entries = append(entries, it.entry())
+	}
+	if err := it.err(); err != nil {
+		t.Fatal("Expected no error iterating, got ", err)
+	}
+	return entries
+}
+
+func TestMemtablePutKeepsOrder(t *testing.T) {
+	m := &memtable{}
+	m.put(lsmEntry{key: "b", value: "1"})
+	m.put(lsmEntry{key: "a", value: "2"})
+	m.put(lsmEntry{key: "c", value: "3"})
+	m.put(lsmEntry{key: "b", value: "4"})
+
+	got := collectEntries(t, m.scan("b"))
+	if len(got) != 2 || got[0].key != "b" || got[0].value != "4" || got[1].key != "c" {
+		t.Errorf("Expected entries b=4, c=3 from scan, got %v", got)
+	}
+}
+
+func TestSegmentScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &memtable{}
+	for i := 0; i < 1000; i++ {
+		m.put(lsmEntry{key: fmt.Sprintf("key-%04d", i), value: fmt.Sprint(i), tombstone: i%100 == 0})
+	}
+
+	path := segmentPath(dir, 1)
+	if err := writeSegment(path, m.scan(""), false); err != nil {
+		t.Fatal("Expected no error writing segment, got ", err)
+	}
+	seg, err := openSegment(path, 1)
+	if err != nil {
+		t.Fatal("Expected no error opening segment, got ", err)
+	}
+	defer seg.file.Close()
+
+	got := collectEntries(t, seg.scan("key-0500"))
+	if len(got) != 500 {
+		t.Fatal("Expected 500 entries scanning from the middle of the segment, got ", len(got))
+	}
+	if got[0].key != "key-0500" || !got[0].tombstone || got[1].value != "501" {
+		t.Errorf("Unexpected entries at start of scan: %v", got[:2])
+	}
+
+	got = collectEntries(t, seg.scan("key-0500x"))
+	if len(got) != 499 || got[0].key != "key-0501" {
+		t.Error("Expected scan to start at the first key after an absent key")
+	}
+}
+
+func TestSegmentDetectsTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &memtable{}
+	m.put(lsmEntry{key: "a", value: "1"})
+	path := segmentPath(dir, 1)
+	if err := writeSegment(path, m.scan(""), false); err != nil {
+		t.Fatal(err)
+	}
+
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.sst")
+	ioutil.WriteFile(truncated, dat[:len(dat)-1], 0644)
+
+	if _, err := openSegment(truncated, 2); err != ErrCorruptSegment {
+		t.Errorf("Expected '%v' opening a truncated segment, got '%v'", ErrCorruptSegment, err)
+	}
+}
+
+func TestMergeIteratorPrefersNewest(t *testing.T) {
+	newest := &memtable{}
+	newest.put(lsmEntry{key: "b", tombstone: true})
+	newest.put(lsmEntry{key: "c", value: "new"})
+
+	oldest := &memtable{}
+	oldest.put(lsmEntry{key: "a", value: "old"})
+	oldest.put(lsmEntry{key: "b", value: "old"})
+	oldest.put(lsmEntry{key: "c", value: "old"})
+
+	merged := newMergeIterator([]lsmIterator{newest.scan(""), oldest.scan("")})
+	got := collectEntries(t, &liveIterator{it: merged})
+
+	if len(got) != 2 || got[0].key != "a" || got[1].key != "c" || got[1].value != "new" {
+		t.Errorf("Expected live entries a=old and c=new, got %v", got)
+	}
+}
@@ -0,0 +1,199 @@
+package simplegraphdb
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TermKind distinguishes the kinds of RDF term a graph can hold
+type TermKind int
+
+const (
+	// LiteralTerm is a string, optionally tagged with a language or a datatype IRI
+	LiteralTerm TermKind = iota
+	// IRITerm is a resource identified by an IRI
+	IRITerm
+	// BlankTerm is a blank node, a resource identified only within its graph
+	BlankTerm
+)
+
+// Term is an RDF term: the subject, property or object of a triple. Plain
+// literals are the strings the store has always held, so existing data and
+// queries are unchanged
+type Term struct {
+	Kind     TermKind
+	Value    string
+	Datatype string // the datatype IRI of a typed literal
+	Lang     string // the language tag of a literal, eg. "fr"
+}
+
+// NewIRI creates an IRI term
+func NewIRI(iri string) Term {
+	return Term{Kind: IRITerm, Value: iri}
+}
+
+// NewBlankNode creates a blank node term with a graph-local label
+func NewBlankNode(label string) Term {
+	return Term{Kind: BlankTerm, Value: label}
+}
+
+// NewLiteral creates a plain literal term
+func NewLiteral(value string) Term {
+	return Term{Kind: LiteralTerm, Value: value}
+}
+
+// NewLangLiteral creates a literal term tagged with a language
+func NewLangLiteral(value, lang string) Term {
+	return Term{Kind: LiteralTerm, Value: value, Lang: lang}
+}
+
+// NewTypedLiteral creates a literal term with a datatype IRI
+func NewTypedLiteral(value, datatype string) Term {
+	return Term{Kind: LiteralTerm, Value: value, Datatype: datatype}
+}
+
+// String renders a term in a Turtle-like form, eg. <http://example.org/a>,
+// _:b0, "France"@fr or "12"^^<http://www.w3.org/2001/XMLSchema#int>. Plain
+// literals are rendered unquoted unless they'd be mistaken for another kind
+// of term. ParseTerm reverses it, and it's the form terms take in the store's
+// string based methods, query results and saved files
+func (t Term) String() string {
+	switch t.Kind {
+	case IRITerm:
+		return "<" + t.Value + ">"
+	case BlankTerm:
+		return "_:" + t.Value
+	}
+
+	switch {
+	case t.Lang != "":
+		return strconv.Quote(t.Value) + "@" + t.Lang
+	case t.Datatype != "":
+		return strconv.Quote(t.Value) + "^^<" + t.Datatype + ">"
+	case strings.HasPrefix(t.Value, "<") || strings.HasPrefix(t.Value, "_:") || strings.HasPrefix(t.Value, `"`):
+		return strconv.Quote(t.Value)
+	}
+	return t.Value
+}
+
+// ParseTerm reads a term from the form written by Term.String. Any string
+// which isn't in one of the term forms is a plain literal
+func ParseTerm(s string) Term {
+	switch {
+	case len(s) >= 2 && s[0] == '<' && s[len(s)-1] == '>':
+		return NewIRI(s[1 : len(s)-1])
+	case strings.HasPrefix(s, "_:"):
+		return NewBlankNode(s[2:])
+	case strings.HasPrefix(s, `"`):
+		if t, ok := parseQuotedLiteral(s); ok {
+			return t
+		}
+	}
+	return NewLiteral(s)
+}
+
+func parseQuotedLiteral(s string) (Term, bool) {
+	// find the closing quote, skipping escaped characters
+	end := -1
+	for i := 1; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == '"' {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return Term{}, false
+	}
+
+	value, err := strconv.Unquote(s[:end+1])
+	if err != nil {
+		return Term{}, false
+	}
+
+	suffix := s[end+1:]
+	switch {
+	case suffix == "":
+		return NewLiteral(value), true
+	case len(suffix) > 1 && suffix[0] == '@':
+		return NewLangLiteral(value, suffix[1:]), true
+	case len(suffix) > 4 && strings.HasPrefix(suffix, "^^<") && suffix[len(suffix)-1] == '>':
+		return NewTypedLiteral(value, suffix[3:len(suffix)-1]), true
+	}
+	return Term{}, false
+}
+
+// plainLiteral gives the form written by Term.String of a raw string held as a
+// plain literal, which is how Add, Remove and transactions take their strings
+func plainLiteral(s string) string {
+	return NewLiteral(s).String()
+}
+
+// plainLiteralPattern is plainLiteral for the constants of a pattern in which
+// simplesparql variables act as wildcards
+func plainLiteralPattern(subject, property, object string) (string, string, string) {
+	elems := []string{subject, property, object}
+	for i, elem := range elems {
+		if !isSparqlVariable(elem) {
+			elems[i] = plainLiteral(elem)
+		}
+	}
+	return elems[0], elems[1], elems[2]
+}
+
+// canonicalTerm rewrites a string into the form its term is stored under
+func canonicalTerm(s string) string {
+	return ParseTerm(s).String()
+}
+
+var turtlePrefixDecl = regexp.MustCompile(`(?mi)^\s*@?prefix\s+([A-Za-z][-\w.]*)?:\s*<([^>]*)>`)
+
+// turtlePrefixes reads the namespaces a Turtle file declares with @prefix or
+// PREFIX, keyed by their prefix
+func turtlePrefixes(dat []byte) map[string]string {
+	prefixes := map[string]string{}
+	for _, decl := range turtlePrefixDecl.FindAllSubmatch(dat, -1) {
+		prefixes[string(decl[1])] = string(decl[2])
+	}
+	return prefixes
+}
+
+// expandPrefixedName gives the IRI of a prefixed name, eg. gn:Country, or
+// false if it doesn't start with a declared prefix
+func expandPrefixedName(name string, prefixes map[string]string) (string, bool) {
+	i := strings.Index(name, ":")
+	if i < 0 {
+		return "", false
+	}
+	namespace, ok := prefixes[name[:i]]
+	if !ok {
+		return "", false
+	}
+	return namespace + name[i+1:], true
+}
+
+// turtleTerm reads a term from the strings produced by the Turtle parser.
+// Prefixed names, including the datatypes of literals, are expanded with the
+// file's prefixes, and strings in none of the term forms are plain literals
+func turtleTerm(s string, prefixes map[string]string) Term {
+	switch {
+	case strings.HasPrefix(s, "<") || strings.HasPrefix(s, "_:"):
+		return ParseTerm(s)
+	case strings.HasPrefix(s, `"`):
+		if i := strings.LastIndex(s, `"^^`); i >= 0 && !strings.HasPrefix(s[i+3:], "<") {
+			datatype := s[i+3:]
+			if iri, ok := expandPrefixedName(datatype, prefixes); ok {
+				datatype = iri
+			}
+			s = s[:i+3] + "<" + datatype + ">"
+		}
+		return ParseTerm(s)
+	}
+
+	if iri, ok := expandPrefixedName(s, prefixes); ok {
+		return NewIRI(iri)
+	}
+	return NewLiteral(s)
+}
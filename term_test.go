@@ -0,0 +1,251 @@
+package simplegraphdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTermStringRoundTrip(t *testing.T) {
+	cases := []struct {
+		term     Term
+		expected string
+	}{
+		{NewLiteral("Apple"), "Apple"},
+		{NewLiteral(""), ""},
+		{NewLiteral("<not an iri>"), `"<not an iri>"`},
+		{NewLiteral("_:not a blank node"), `"_:not a blank node"`},
+		{NewLiteral(`"quoted"`), `"\"quoted\""`},
+		{NewIRI("http://example.org/a"), "<http://example.org/a>"},
+		{NewBlankNode("b0"), "_:b0"},
+		{NewLangLiteral("France", "fr"), `"France"@fr`},
+		{NewTypedLiteral("12", "http://www.w3.org/2001/XMLSchema#int"), `"12"^^<http://www.w3.org/2001/XMLSchema#int>`},
+	}
+
+	for _, c := range cases {
+		if s := c.term.String(); s != c.expected {
+			t.Errorf("Expected %#v to render as %s, got %s", c.term, c.expected, s)
+		}
+		if parsed := ParseTerm(c.term.String()); parsed != c.term {
+			t.Errorf("Expected %s to parse as %#v, got %#v", c.term.String(), c.term, parsed)
+		}
+	}
+}
+
+func TestParseTermMalformed(t *testing.T) {
+	for _, s := range []string{`"unterminated`, `"trailing"junk`, "<unterminated", `"bad escape \q"`} {
+		if term := ParseTerm(s); term != NewLiteral(s) {
+			t.Errorf("Expected %s to parse as a plain literal, got %#v", s, term)
+		}
+	}
+}
+
+func TestTurtleTerm(t *testing.T) {
+	prefixes := turtlePrefixes([]byte(`@prefix gn: <http://www.geonames.org/ontology#>.
+@prefix rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#> .
+PREFIX xsd: <http://www.w3.org/2001/XMLSchema#>
+@prefix : <http://example.org/> .
+<http://example.org/a> gn:name "Andorra" .`))
+
+	cases := map[string]Term{
+		"<http://example.org/a>":   NewIRI("http://example.org/a"),
+		"gn:Country":               NewIRI("http://www.geonames.org/ontology#Country"),
+		"rdf:type":                 NewIRI(rdfType),
+		":a":                       NewIRI("http://example.org/a"),
+		"_:b0":                     NewBlankNode("b0"),
+		`"Andorra"@en`:             NewLangLiteral("Andorra", "en"),
+		`"12"^^xsd:int`:            NewTypedLiteral("12", "http://www.w3.org/2001/XMLSchema#int"),
+		`"12"^^<http://a.org/int>`: NewTypedLiteral("12", "http://a.org/int"),
+		"72000":                    NewLiteral("72000"),
+		"Andorra la Vella":         NewLiteral("Andorra la Vella"),
+		"12:30":                    NewLiteral("12:30"),
+		"undeclared:name":          NewLiteral("undeclared:name"),
+	}
+
+	for s, expected := range cases {
+		if term := turtleTerm(s, prefixes); term != expected {
+			t.Errorf("Expected %s to read as %#v, got %#v", s, expected, term)
+		}
+	}
+}
+
+func TestInitHexastoreFromTurtleExpandsPrefixes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbFilePath := filepath.Join(dir, "countries.ttl")
+	dat := `@prefix gn: <http://www.geonames.org/ontology#> .
+@prefix rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#> .
+<http://example.org/fr> rdf:type gn:Country .
+<http://example.org/de> a gn:Country .
+`
+	if err := ioutil.WriteFile(dbFilePath, []byte(dat), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := InitHexastoreFromTurtle(dbFilePath)
+	if err != nil {
+		t.Fatal("Expected no error loading Turtle, got ", err)
+	}
+
+	// rdf:type and a are the same predicate once expanded
+	results, err := runQuery("SELECT ?c WHERE { ?c <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <http://www.geonames.org/ontology#Country> }", store)
+	expected := [][]string{{"?c"}, {"<http://example.org/fr>"}, {"<http://example.org/de>"}}
+	if err != nil || len(results) != len(expected) || !checkResultsEquality(results, expected) {
+		t.Errorf("Expected %v, got %v, %v", expected, results, err)
+	}
+}
+
+func TestStoreDistinguishesTermKinds(t *testing.T) {
+	h := newHexastore()
+	h.AddTerms(NewIRI("http://example.org/fr"), NewIRI("http://example.org/name"), NewLangLiteral("France", "fr"), "")
+	h.AddTerms(NewIRI("http://example.org/fr"), NewIRI("http://example.org/name"), NewLiteral("France"), "")
+	h.AddTerms(NewIRI("http://example.org/fr"), NewIRI("http://example.org/code"), NewTypedLiteral("250", "http://www.w3.org/2001/XMLSchema#int"), "")
+
+	if n := len(*h.QueryXXX()); n != 3 {
+		t.Errorf("Expected 3 distinct triples, got %d", n)
+	}
+
+	id, ok := h.GetEntityKey(`"France"@fr`)
+	if !ok {
+		t.Fatal(`Expected to find "France"@fr`)
+	}
+	if term := h.ResolveEntityTerm(id); term != NewLangLiteral("France", "fr") {
+		t.Errorf("Expected a literal tagged fr, got %#v", term)
+	}
+}
+
+func TestAddStoresPlainLiterals(t *testing.T) {
+	h := newHexastore()
+	h.Add("alice", "bio", "<b>hi</b>", "")
+	h.Add("bob", "quote", `"hi" she said`, "")
+	h.Add("carol", "friend", "_:dave", "")
+
+	for _, s := range []string{"<b>hi</b>", `"hi" she said`, "_:dave"} {
+		id, ok := h.entities.GetTermKey(NewLiteral(s))
+		if !ok {
+			t.Errorf("Expected %s to be stored as a plain literal", s)
+			continue
+		}
+		if term := h.ResolveEntityTerm(id); term != NewLiteral(s) {
+			t.Errorf("Expected %s to be stored as a plain literal, got %#v", s, term)
+		}
+	}
+
+	cases := []struct {
+		query    string
+		expected [][]string
+	}{
+		{"SELECT ?p WHERE { ?p 'bio' '<b>hi</b>' }", [][]string{{"?p"}, {"alice"}}},
+		{"SELECT ?q WHERE { 'bob' 'quote' ?q }", [][]string{{"?q"}, {`"hi" she said`}}},
+		{"SELECT ?f WHERE { 'carol' 'friend' ?f }", [][]string{{"?f"}, {"_:dave"}}},
+	}
+	for _, c := range cases {
+		results, err := runQuery(c.query, h)
+		if err != nil || len(results) != len(c.expected) || !checkResultsEquality(results, c.expected) {
+			t.Errorf("%s: expected %v, got %v, %v", c.query, c.expected, results, err)
+		}
+	}
+
+	if !h.Remove("alice", "bio", "<b>hi</b>") {
+		t.Error("Expected to remove the triple added with a plain literal")
+	}
+	if removed := h.RemoveMatching("?s", "quote", `"hi" she said`); removed != 1 {
+		t.Errorf("Expected to remove 1 triple matching a plain literal, removed %d", removed)
+	}
+}
+
+func Test_runQueryWithTerms(t *testing.T) {
+	h := newHexastore()
+	fr := NewIRI("http://example.org/fr")
+	h.AddTerms(fr, NewIRI("http://example.org/name"), NewLangLiteral("France", "fr"), "")
+	h.AddTerms(fr, NewIRI("http://example.org/name"), NewLangLiteral("France", "en"), "")
+	h.AddTerms(fr, NewIRI("http://example.org/code"), NewTypedLiteral("250", "http://www.w3.org/2001/XMLSchema#int"), "")
+	h.AddTerms(fr, NewIRI("http://example.org/label"), NewLiteral("France"), "")
+	h.AddTerms(NewBlankNode("b0"), NewIRI("http://example.org/locatedIn"), fr, "")
+	h.Add("alice", "age", "30", "")
+	h.Add("alice", "active", "true", "")
+
+	cases := []struct {
+		comment  string
+		query    string
+		expected [][]string
+	}{
+		{
+			comment: "IRI constants and rendered literals",
+			query:   "SELECT ?name WHERE { <http://example.org/fr> <http://example.org/name> ?name }",
+			expected: [][]string{
+				[]string{"?name"},
+				[]string{`"France"@fr`},
+				[]string{`"France"@en`},
+			},
+		},
+		{
+			comment: "language tagged constant",
+			query:   "SELECT ?p WHERE { ?x ?p 'France'@en }",
+			expected: [][]string{
+				[]string{"?p"},
+				[]string{"<http://example.org/name>"},
+			},
+		},
+		{
+			comment: "plain constant doesn't match tagged literals",
+			query:   "SELECT ?p WHERE { ?x ?p 'France' }",
+			expected: [][]string{
+				[]string{"?p"},
+				[]string{"<http://example.org/label>"},
+			},
+		},
+		{
+			comment: "typed constant",
+			query:   "SELECT ?x WHERE { ?x <http://example.org/code> '250'^^<http://www.w3.org/2001/XMLSchema#int> }",
+			expected: [][]string{
+				[]string{"?x"},
+				[]string{"<http://example.org/fr>"},
+			},
+		},
+		{
+			comment: "blank node",
+			query:   "SELECT ?x WHERE { ?x <http://example.org/locatedIn> <http://example.org/fr> }",
+			expected: [][]string{
+				[]string{"?x"},
+				[]string{"_:b0"},
+			},
+		},
+		{
+			comment: "number constant",
+			query:   "SELECT ?p WHERE { ?p 'age' 30 }",
+			expected: [][]string{
+				[]string{"?p"},
+				[]string{"alice"},
+			},
+		},
+		{
+			comment: "boolean constant",
+			query:   "SELECT ?p WHERE { ?p 'active' TRUE }",
+			expected: [][]string{
+				[]string{"?p"},
+				[]string{"alice"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		results, err := runQuery(c.query, h)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", c.comment, err)
+			continue
+		}
+		if len(results) != len(c.expected) || !checkResultsEquality(results, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.comment, c.expected, results)
+		}
+	}
+
+	if _, err := runQuery("SELECT ?p WHERE { ?p 'age' NULL }", h); err == nil {
+		t.Error("Expected an error from a NULL constant")
+	}
+}
@@ -0,0 +1,115 @@
+package simplegraphdb
+
+import "errors"
+
+// ErrTxDone is returned when committing or rolling back a transaction that
+// has already been committed or rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx is a batch of updates to a Hexastore. Updates are buffered until Commit,
+// which applies all of them atomically, or Rollback, which discards them.
+// Like Hexastore.Add, their strings are plain literals. A Tx is not safe for
+// concurrent use
+type Tx interface {
+	Add(subject, property, object, value string)
+	Remove(subject, property, object string)
+	Commit() error
+	Rollback() error
+}
+
+// txOp is a single buffered update of a transaction. Its terms are in the
+// form written by Term.String
+type txOp struct {
+	remove   bool
+	subject  string
+	property string
+	object   string
+	value    string
+	graph    string // the named graph updated, or "" for the store the op is applied to
+}
+
+type hexastoreTx struct {
+	commit func(ops []txOp) error
+	ops    []txOp
+	done   bool
+}
+
+// Begin starts a new transaction against the hexastore
+func (store *HexastoreDB) Begin() Tx {
+	return &hexastoreTx{commit: store.applyBatch}
+}
+
+// Add buffers the addition of a triple until the transaction commits
+func (tx *hexastoreTx) Add(subject, property, object, value string) {
+	if tx.done {
+		return
+	}
+	tx.ops = append(tx.ops, txOp{subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object), value: value})
+}
+
+// Remove buffers the removal of a triple until the transaction commits
+func (tx *hexastoreTx) Remove(subject, property, object string) {
+	if tx.done {
+		return
+	}
+	tx.ops = append(tx.ops, txOp{remove: true, subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object)})
+}
+
+// Commit applies the buffered updates in the order they were made. Readers
+// see either all of them or none
+func (tx *hexastoreTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	ops := tx.ops
+	tx.ops = nil
+	return tx.commit(ops)
+}
+
+// Rollback discards the buffered updates
+func (tx *hexastoreTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+
+	return nil
+}
+
+// applyBatch performs a batch of updates while holding the store's write lock
+func (store *HexastoreDB) applyBatch(ops []txOp) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, op := range ops {
+		store.apply(op)
+	}
+
+	return nil
+}
+
+// apply performs a single update, returning false if it was the removal of
+// a triple which wasn't in the store. The caller must hold the store's write lock
+func (store *HexastoreDB) apply(op txOp) bool {
+	if op.graph != "" {
+		store = store.namedGraph(op.graph)
+	}
+
+	if !op.remove {
+		subjID, propID, objID := store.mapStringsToIds(op.subject, op.property, op.object)
+		store.add(MakeTriple(subjID, propID, objID, op.value))
+		return true
+	}
+
+	subjID, subjOk := store.entities.GetKey(op.subject)
+	propID, propOk := store.props.GetKey(op.property)
+	objID, objOk := store.entities.GetKey(op.object)
+	if !subjOk || !propOk || !objOk {
+		return false
+	}
+
+	return store.remove(MakeTriple(subjID, propID, objID, ""))
+}
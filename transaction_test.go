@@ -0,0 +1,112 @@
+package simplegraphdb
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTxCommit(t *testing.T) {
+	hexastore := newHexastore()
+	hexastore.Add("alice", "follows", "carol", "")
+
+	tx := hexastore.Begin()
+	tx.Add("alice", "follows", "bob", "")
+	tx.Add("bob", "follows", "alice", "")
+	tx.Remove("alice", "follows", "carol")
+
+	if len(*hexastore.QueryXXX()) != 1 {
+		t.Error("Uncommitted transaction updates were visible in the store")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Error("Expected no error from Commit, got ", err)
+	}
+
+	got := *PresentableResults(hexastore.QueryXXX(), hexastore)
+	if len(got) != 2 {
+		t.Errorf("Expected 2 triples after commit, got %v", got)
+	}
+	if hexastore.Remove("alice", "follows", "carol") {
+		t.Error("Expected transaction to have removed 'alice -> follows -> carol'")
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	hexastore := newHexastore()
+
+	tx := hexastore.Begin()
+	tx.Add("alice", "follows", "bob", "")
+
+	if err := tx.Rollback(); err != nil {
+		t.Error("Expected no error from Rollback, got ", err)
+	}
+	if len(*hexastore.QueryXXX()) != 0 {
+		t.Error("Rolled back transaction updates were applied to the store")
+	}
+}
+
+func TestTxFinished(t *testing.T) {
+	hexastore := newHexastore()
+
+	tx := hexastore.Begin()
+	tx.Commit()
+	tx.Add("alice", "follows", "bob", "")
+
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("Expected '%v' committing twice, got '%v'", ErrTxDone, err)
+	}
+	if err := tx.Rollback(); err != ErrTxDone {
+		t.Errorf("Expected '%v' rolling back a committed transaction, got '%v'", ErrTxDone, err)
+	}
+	if len(*hexastore.QueryXXX()) != 0 {
+		t.Error("Updates made after commit were applied to the store")
+	}
+}
+
+func TestTxAppliesInOrder(t *testing.T) {
+	hexastore := newHexastore()
+
+	tx := hexastore.Begin()
+	tx.Add("alice", "follows", "bob", "")
+	tx.Remove("alice", "follows", "bob")
+	tx.Remove("bob", "follows", "alice")
+	tx.Add("bob", "follows", "alice", "")
+	tx.Commit()
+
+	got := *PresentableResults(hexastore.QueryXXX(), hexastore)
+	if len(got) != 1 || got[0] != "bob -> follows -> alice" {
+		t.Errorf("Expected only 'bob -> follows -> alice', got %v", got)
+	}
+}
+
+func TestTxReadersNeverSeePartialCommit(t *testing.T) {
+	hexastore := newHexastore()
+	batchSize := 10
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for b := 0; b < 50; b++ {
+			tx := hexastore.Begin()
+			for i := 0; i < batchSize; i++ {
+				tx.Add(fmt.Sprintf("user-%d-%d", b, i), "follows", "alice", "")
+			}
+			tx.Commit()
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if n := len(*hexastore.QueryXXX()); n%batchSize != 0 {
+				t.Errorf("Reader observed %d triples, part way through a transaction", n)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,530 @@
+package simplegraphdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot"
+
+	walAdd        byte = 0
+	walRemove     byte = 1
+	walAddQuad    byte = 2
+	walRemoveQuad byte = 3
+
+	// each log record starts with the length and CRC-32 of its payload
+	walHeaderSize = 8
+)
+
+// ErrStoreClosed is returned when updating a DurableHexastore after Close
+var ErrStoreClosed = errors.New("durable hexastore has been closed")
+
+// ErrCorruptWAL is returned when opening a DurableHexastore whose write-ahead
+// log holds a damaged record which can't be the result of a crash part way
+// through an append, such as one with more records after it
+var ErrCorruptWAL = errors.New("write-ahead log is corrupt")
+
+// errWALChecksum is returned when a record doesn't match its checksum
+var errWALChecksum = errors.New("write-ahead log record checksum mismatch")
+
+// SyncPolicy controls how often a DurableHexastore fsyncs its write-ahead log
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the log after every update, before the update is applied
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs the log every WALOptions.SyncInterval, so a machine
+	// crash can lose the updates made since the last sync
+	SyncInterval
+	// SyncNever leaves flushing the log to disk up to the operating system
+	SyncNever
+)
+
+// WALOptions configures a DurableHexastore's write-ahead log
+type WALOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+// DurableHexastore is a HexastoreDB which records every update in an append-only
+// write-ahead log before applying it, so that its contents survive a crash.
+// Opening the store loads its latest snapshot and replays the log on top of it.
+//
+// Add can't return an error, so the first failure to write the log is kept and
+// returned by Err, and every update after it is rejected
+type DurableHexastore struct {
+	*HexastoreDB
+	dir   string
+	log   *writeAheadLog
+	graph string // the named graph updated through this view of the store, or ""
+}
+
+// writeAheadLog is shared by a DurableHexastore and the views of its named
+// graphs. Its fields are guarded by the store's lock
+type writeAheadLog struct {
+	file   *os.File
+	opts   WALOptions
+	err    error
+	closed bool
+	stop   chan struct{}
+	done   sync.WaitGroup
+}
+
+// OpenDurableHexastore opens the durable store kept in dir, creating it if needed
+func OpenDurableHexastore(dir string, opts WALOptions) (*DurableHexastore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	hexastore, err := InitHexastoreFromSnapshot(filepath.Join(dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		hexastore, err = newHexastore(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = replayLog(log, hexastore); err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	wal := &writeAheadLog{file: log, opts: opts, stop: make(chan struct{})}
+	if opts.Sync == SyncInterval {
+		wal.done.Add(1)
+		go wal.syncPeriodically()
+	}
+	store := &DurableHexastore{HexastoreDB: hexastore, dir: dir, log: wal}
+
+	return store, nil
+}
+
+// replayLog applies every complete record of the log to the store. A torn record
+// left at the end of the log by a crash, along with any zeros or stale bytes after
+// it, is discarded, truncating the log so that new records follow the last
+// complete one. A damaged record followed by a valid one fails with
+// ErrCorruptWAL, leaving the log untouched
+func replayLog(log *os.File, store *HexastoreDB) error {
+	info, err := log.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(log)
+	var offset int64
+	for {
+		ops, size, err := readWALRecord(reader, info.Size()-offset)
+		if err == errWALChecksum {
+			if validRecordFollows(reader, info.Size()-offset-size) {
+				return ErrCorruptWAL
+			}
+			break
+		}
+		if err == ErrCorruptWAL {
+			return err
+		}
+		if err != nil {
+			break
+		}
+		for _, op := range ops {
+			store.apply(op)
+		}
+		offset += size
+	}
+
+	if offset == info.Size() {
+		return nil
+	}
+	if err = log.Truncate(offset); err != nil {
+		return err
+	}
+	return log.Sync()
+}
+
+// validRecordFollows reads the rest of the log after a damaged record, giving
+// whether it holds a record matching its checksum. A crash only leaves a torn
+// record or filler such as zeros at the end of the log, never a whole record
+func validRecordFollows(reader *bufio.Reader, remaining int64) bool {
+	for {
+		_, size, err := readWALRecord(reader, remaining)
+		switch err {
+		case nil, ErrCorruptWAL:
+			return true
+		case errWALChecksum:
+			remaining -= size
+		default:
+			return false
+		}
+	}
+}
+
+func (wal *writeAheadLog) syncPeriodically() {
+	defer wal.done.Done()
+
+	interval := wal.opts.SyncInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			wal.file.Sync()
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// writeLog appends a record of a batch of updates to the log. The caller must hold
+// the store's write lock, and must not apply the updates if an error is returned
+func (store *DurableHexastore) writeLog(ops []txOp) error {
+	wal := store.log
+	if wal.closed {
+		return ErrStoreClosed
+	}
+	if wal.err != nil {
+		return wal.err
+	}
+
+	if _, err := wal.file.Write(encodeWALRecord(ops)); err != nil {
+		wal.err = err
+		return err
+	}
+	if wal.opts.Sync == SyncAlways {
+		if err := wal.file.Sync(); err != nil {
+			wal.err = err
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyBatch logs a batch of updates and then applies them while holding the
+// store's write lock. Updates made through a named graph's view are logged
+// against that graph
+func (store *DurableHexastore) applyBatch(ops []txOp) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for i := range ops {
+		if ops[i].graph == "" {
+			ops[i].graph = store.graph
+		}
+	}
+	if err := store.writeLog(ops); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		store.apply(op)
+	}
+
+	return nil
+}
+
+// Add logs and then introduces a new triple of plain literals into the store
+func (store *DurableHexastore) Add(subject, property, object, value string) {
+	store.applyBatch([]txOp{{subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object), value: value}})
+}
+
+// AddTerms logs and then introduces a new triple of RDF terms into the store
+func (store *DurableHexastore) AddTerms(subject, property, object Term, value string) {
+	store.applyBatch([]txOp{{subject: subject.String(), property: property.String(), object: object.String(), value: value}})
+}
+
+// Remove logs and then deletes a triple of plain literals from the store, returning false
+// if the triple wasn't in the store or the removal couldn't be logged
+func (store *DurableHexastore) Remove(subject, property, object string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	op := txOp{remove: true, subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object), graph: store.graph}
+	if err := store.writeLog([]txOp{op}); err != nil {
+		return false
+	}
+
+	return store.apply(op)
+}
+
+// RemoveMatching logs and then deletes every triple matching a pattern in which
+// simplesparql variables (eg. "?x") act as wildcards and other strings are plain
+// literals, returning the number of triples removed
+func (store *DurableHexastore) RemoveMatching(subject, property, object string) int {
+	subject, property, object = plainLiteralPattern(subject, property, object)
+	matches := retreiveQueryResults(subject, property, object, store.HexastoreDB)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	ops := []txOp{}
+	for _, t := range *matches {
+		if _, ok := store.SPO[t.Subject][t.Prop][t.Object]; ok {
+			s, _ := store.entities.Get(t.Subject)
+			p, _ := store.props.Get(t.Prop)
+			o, _ := store.entities.Get(t.Object)
+			ops = append(ops, txOp{remove: true, subject: s, property: p, object: o, graph: store.graph})
+		}
+	}
+
+	if len(ops) == 0 || store.writeLog(ops) != nil {
+		return 0
+	}
+	for _, op := range ops {
+		store.apply(op)
+	}
+
+	return len(ops)
+}
+
+// Begin starts a new transaction against the store. Committing it writes all
+// of its updates to the log as a single record, so a crash part way through
+// a commit can't leave it half applied
+func (store *DurableHexastore) Begin() Tx {
+	return &hexastoreTx{commit: store.applyBatch}
+}
+
+// AddQuad logs and then introduces a new triple of plain literals into a named
+// graph of the store
+func (store *DurableHexastore) AddQuad(subject, property, object, value, graph string) {
+	store.applyBatch([]txOp{{subject: plainLiteral(subject), property: plainLiteral(property), object: plainLiteral(object), value: value, graph: graph}})
+}
+
+// Graph finds a named graph of the store, giving a view of it whose updates
+// are logged like those of the store
+func (store *DurableHexastore) Graph(name string) (Hexastore, bool) {
+	graph, ok := store.HexastoreDB.Graph(name)
+	if !ok {
+		return nil, false
+	}
+	return &DurableHexastore{HexastoreDB: graph.(*HexastoreDB), dir: store.dir, log: store.log, graph: name}, true
+}
+
+// Union gives a view of the store which queries the union of its default graph
+// and every named graph. Updates made through the view are logged and go to the
+// default graph
+func (store *DurableHexastore) Union() Hexastore {
+	root := store.rootGraph()
+	return &unionGraph{store: root, defaultGraph: &DurableHexastore{HexastoreDB: root, dir: store.dir, log: store.log}}
+}
+
+// Err returns the first error hit writing the log, after which
+// the store rejects updates, or ErrStoreClosed once the store is closed
+func (store *DurableHexastore) Err() error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if store.log.err == nil && store.log.closed {
+		return ErrStoreClosed
+	}
+	return store.log.err
+}
+
+// Compact writes a snapshot of the store and empties the log, so that reopening
+// the store doesn't have to replay every update since it was created
+func (store *DurableHexastore) Compact() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	wal := store.log
+	if wal.closed {
+		return ErrStoreClosed
+	}
+	if wal.err != nil {
+		return wal.err
+	}
+
+	if err := writeSnapshot(filepath.Join(store.dir, snapshotFileName), store.HexastoreDB); err != nil {
+		return err
+	}
+	if err := wal.file.Truncate(0); err != nil {
+		wal.err = err
+		return err
+	}
+	if err := wal.file.Sync(); err != nil {
+		wal.err = err
+		return err
+	}
+
+	return nil
+}
+
+// Close syncs and closes the log. The store can still be queried after
+// it's closed, but not updated
+func (store *DurableHexastore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	wal := store.log
+	if wal.closed {
+		return ErrStoreClosed
+	}
+	wal.closed = true
+
+	close(wal.stop)
+	wal.done.Wait()
+
+	err := wal.file.Sync()
+	if closeErr := wal.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func appendWALString(buf []byte, s string) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(s)))
+	return append(append(buf, lenBuf[:n]...), s...)
+}
+
+func encodeWALRecord(ops []txOp) []byte {
+	var countBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(countBuf[:], uint64(len(ops)))
+
+	record := make([]byte, walHeaderSize, 64)
+	record = append(record, countBuf[:n]...)
+	for _, op := range ops {
+		switch {
+		case op.remove && op.graph != "":
+			record = append(record, walRemoveQuad)
+		case op.remove:
+			record = append(record, walRemove)
+		case op.graph != "":
+			record = append(record, walAddQuad)
+		default:
+			record = append(record, walAdd)
+		}
+		record = appendWALString(record, op.subject)
+		record = appendWALString(record, op.property)
+		record = appendWALString(record, op.object)
+		if !op.remove {
+			record = appendWALString(record, op.value)
+		}
+		if op.graph != "" {
+			record = appendWALString(record, op.graph)
+		}
+	}
+
+	payload := record[walHeaderSize:]
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return record
+}
+
+// readWALRecord reads the next record from the log, returning its updates and
+// its size in bytes. remaining bounds the payload length so a corrupt header
+// can't force a huge allocation. A record which is cut short fails with
+// io.EOF or io.ErrUnexpectedEOF, and one which doesn't match its checksum
+// fails with errWALChecksum, still giving its size. Every record holds at least
+// its count of updates, so an empty one such as a header of zeros left by a
+// crash fails with errWALChecksum too
+func readWALRecord(reader *bufio.Reader, remaining int64) ([]txOp, int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if size == 0 {
+		return nil, walHeaderSize, errWALChecksum
+	}
+	if size > remaining-walHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, walHeaderSize + size, errWALChecksum
+	}
+
+	ops, err := decodeWALPayload(payload)
+	return ops, walHeaderSize + size, err
+}
+
+type walDecoder struct {
+	buf     []byte
+	corrupt bool
+}
+
+func (d *walDecoder) readByte() byte {
+	if len(d.buf) == 0 {
+		d.corrupt = true
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *walDecoder) readUint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.corrupt = true
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *walDecoder) readString() string {
+	n := d.readUint()
+	if n > uint64(len(d.buf)) {
+		d.corrupt = true
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func decodeWALPayload(payload []byte) ([]txOp, error) {
+	d := &walDecoder{buf: payload}
+
+	count := d.readUint()
+	if count > uint64(len(d.buf)) {
+		return nil, ErrCorruptWAL
+	}
+
+	ops := make([]txOp, count)
+	for i := range ops {
+		kind := d.readByte()
+		if kind > walRemoveQuad {
+			return nil, ErrCorruptWAL
+		}
+		ops[i].remove = kind == walRemove || kind == walRemoveQuad
+		ops[i].subject = d.readString()
+		ops[i].property = d.readString()
+		ops[i].object = d.readString()
+		if !ops[i].remove {
+			ops[i].value = d.readString()
+		}
+		if kind == walAddQuad || kind == walRemoveQuad {
+			ops[i].graph = d.readString()
+		}
+	}
+	if d.corrupt || len(d.buf) != 0 {
+		return nil, ErrCorruptWAL
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,356 @@
+package simplegraphdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestDurableHexastoreReplaysLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Expected no error opening store, got ", err)
+	}
+	store.Add("alice", "follows", "bob", "")
+	store.Add("alice", "follows", "carol", "")
+	store.Add("bob", "follows", "alice", "since 2017")
+	store.Remove("alice", "follows", "carol")
+
+	tx := store.Begin()
+	tx.Add("carol", "follows", "alice", "")
+	tx.Remove("bob", "follows", "alice")
+	tx.Commit()
+
+	rolledBack := store.Begin()
+	rolledBack.Add("dave", "follows", "alice", "")
+	rolledBack.Rollback()
+
+	expected := dumpHexastore(store)
+	if err := store.Close(); err != nil {
+		t.Fatal("Expected no error closing store, got ", err)
+	}
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Expected no error reopening store, got ", err)
+	}
+	defer reopened.Close()
+
+	if len(expected.Triples) != 2 {
+		t.Errorf("Expected 2 triples in the store, got %v", expected.Triples)
+	}
+	if diff := deep.Equal(expected, dumpHexastore(reopened)); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDurableHexastoreReplaysAddTerms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Expected no error opening store, got ", err)
+	}
+	fr := NewIRI("http://example.org/fr")
+	store.AddTerms(fr, NewIRI("http://example.org/name"), NewLangLiteral("France", "fr"), "official")
+	store.Add("<http://example.org/fr>", "bio", "<b>hi</b>", "")
+	if err := store.Close(); err != nil {
+		t.Fatal("Expected no error closing store, got ", err)
+	}
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Expected no error reopening store, got ", err)
+	}
+	defer reopened.Close()
+
+	results, err := Query("SELECT ?name, ?v WHERE { <http://example.org/fr> <http://example.org/name> ?name VALUE ?v }", reopened)
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+	expected := [][]Binding{{{Term: NewLangLiteral("France", "fr"), Bound: true}, {Term: NewLiteral("official"), Bound: true}}}
+	if diff := deep.Equal(expected, results.Rows); diff != nil {
+		t.Error(diff)
+	}
+
+	// Add's strings are replayed as the plain literals they were added as
+	results, err = Query("SELECT ?s, ?bio WHERE { ?s 'bio' ?bio }", reopened)
+	if err != nil {
+		t.Fatal("Expected no error, got ", err)
+	}
+	expected = [][]Binding{{{Term: NewLiteral("<http://example.org/fr>"), Bound: true}, {Term: NewLiteral("<b>hi</b>"), Bound: true}}}
+	if diff := deep.Equal(expected, results.Rows); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDurableHexastoreRemoveMatching(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "follows", "bob", "")
+	store.Add("alice", "follows", "carol", "")
+	store.Add("bob", "follows", "alice", "")
+
+	if removed := store.RemoveMatching("alice", "?p", "?o"); removed != 2 {
+		t.Error("Expected 2 triples removed, got ", removed)
+	}
+	store.Close()
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	got := dumpHexastore(reopened).Triples
+	if len(got) != 1 || got[0].Subject != "bob" {
+		t.Errorf("Expected only 'bob -> follows -> alice' after replay, got %v", got)
+	}
+}
+
+func TestDurableHexastoreDiscardsTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "follows", "bob", "")
+	store.Close()
+
+	// simulate a crash part way through appending a record
+	torn := encodeWALRecord([]txOp{{subject: "bob", property: "follows", object: "alice"}})
+	log, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Write(torn[:len(torn)-3])
+	log.Close()
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Expected torn record to be discarded without error, got ", err)
+	}
+	if n := len(*reopened.QueryXXX()); n != 1 {
+		t.Error("Expected only the complete record to be replayed, got triples: ", n)
+	}
+
+	// records appended after recovery must follow the last complete one
+	reopened.Add("carol", "follows", "alice", "")
+	reopened.Close()
+
+	again, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(*again.QueryXXX()); n != 2 {
+		t.Error("Expected 2 triples after replaying the recovered log, got ", n)
+	}
+	again.Close()
+
+	// damage the first record, which has a complete record after it, so it
+	// can't be torn and must not be discarded along with the records after it
+	path := filepath.Join(dir, walFileName)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[walHeaderSize] ^= 0xff
+	if err = ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways}); err != ErrCorruptWAL {
+		t.Error("Expected ErrCorruptWAL from a corrupt record mid-log, got ", err)
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(contents) {
+		t.Errorf("Expected the corrupt log to be left at %d bytes, got %d", len(contents), len(after))
+	}
+}
+
+func TestDurableHexastoreDiscardsTornChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "follows", "bob", "")
+	store.Add("bob", "follows", "alice", "")
+	store.Close()
+
+	// a crash can leave the last record at its full length but with stale bytes
+	path := filepath.Join(dir, walFileName)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[len(contents)-1] ^= 0xff
+	if err = ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Expected the last record to be discarded without error, got ", err)
+	}
+	defer reopened.Close()
+
+	if n := len(*reopened.QueryXXX()); n != 1 {
+		t.Error("Expected only the first record to be replayed, got triples: ", n)
+	}
+}
+
+func TestDurableHexastoreDiscardsZeroFilledTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "follows", "bob", "")
+	store.Add("bob", "follows", "alice", "")
+	store.Close()
+
+	// a crash can leave the end of the log extended with a block of zeros
+	path := filepath.Join(dir, walFileName)
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, append(contents, make([]byte, 4096)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal("Expected the zeros to be discarded without error, got ", err)
+	}
+	if n := len(*reopened.QueryXXX()); n != 2 {
+		t.Error("Expected both records to be replayed, got triples: ", n)
+	}
+	reopened.Close()
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(contents) {
+		t.Errorf("Expected the log to be truncated to %d bytes, got %d", len(contents), len(after))
+	}
+
+	// zeros with a complete record after them can't be left by a crash
+	zeros := append(make([]byte, 64), encodeWALRecord([]txOp{{subject: "carol", property: "follows", object: "alice"}})...)
+	if err = ioutil.WriteFile(path, append(contents, zeros...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways}); err != ErrCorruptWAL {
+		t.Error("Expected ErrCorruptWAL from zeros followed by a record, got ", err)
+	}
+}
+
+func TestDurableHexastoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncInterval, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "follows", "bob", "")
+	store.Add("bob", "follows", "alice", "")
+
+	if err := store.Compact(); err != nil {
+		t.Fatal("Expected no error compacting, got ", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, walFileName)); err != nil || info.Size() != 0 {
+		t.Error("Expected compaction to empty the log")
+	}
+
+	store.Remove("bob", "follows", "alice")
+	store.Add("carol", "follows", "alice", "")
+	expected := dumpHexastore(store)
+	store.Close()
+
+	reopened, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncInterval, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if diff := deep.Equal(expected, dumpHexastore(reopened)); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDurableHexastoreClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simplegraphdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenDurableHexastore(dir, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("alice", "follows", "bob", "")
+	store.Close()
+
+	store.Add("bob", "follows", "alice", "")
+	if err := store.Err(); err != ErrStoreClosed {
+		t.Errorf("Expected '%v' after updating a closed store, got '%v'", ErrStoreClosed, err)
+	}
+	if n := len(*store.QueryXXX()); n != 1 {
+		t.Error("Expected update to a closed store not to be applied, got triples: ", n)
+	}
+
+	tx := store.Begin()
+	tx.Add("bob", "follows", "alice", "")
+	if err := tx.Commit(); err != ErrStoreClosed {
+		t.Errorf("Expected '%v' committing to a closed store, got '%v'", ErrStoreClosed, err)
+	}
+	if err := store.Close(); err != ErrStoreClosed {
+		t.Errorf("Expected '%v' closing twice, got '%v'", ErrStoreClosed, err)
+	}
+}